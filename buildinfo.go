@@ -0,0 +1,27 @@
+//go:build go1.18
+// +build go1.18
+
+package influx
+
+import (
+	"runtime/debug"
+)
+
+// buildVersion returns version of the main module or its VCS revision if
+// version is not known. Empty string is returned if build info is not
+// available.
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" {
+			return s.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,21 @@
+//go:build !go1.18
+// +build !go1.18
+
+package influx
+
+import (
+	"runtime/debug"
+)
+
+// buildVersion returns version of the main module. Empty string is returned if
+// build info is not available. VCS revision is stamped only since go1.18.
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	if v := info.Main.Version; v != "(devel)" {
+		return v
+	}
+	return ""
+}
@@ -0,0 +1,120 @@
+package influx
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	client "github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+)
+
+// Encoder converts data points to text lines written by Output() and
+// LineProtocolSink(). It allows shipping metrics mapped by reporter to
+// backends other than influx DB, e.g. Graphite.
+type Encoder interface {
+	// Encode returns lines representing a data point without trailing
+	// newlines. Precision is timestamp precision of the point.
+	Encode(p *client.Point, precision string) []string
+}
+
+// LineProtocolEncoder returns encoder of influx line protocol. Timestamps are
+// written in precision units, or in nanoseconds truncated to precision if
+// nanos is true.
+func LineProtocolEncoder(nanos bool) Encoder {
+	return lineProtocolEncoder{nanos: nanos}
+}
+
+// lineProtocolEncoder is an encoder created by LineProtocolEncoder().
+type lineProtocolEncoder struct {
+	nanos bool
+}
+
+// Encode returns a single line of a point.
+func (e lineProtocolEncoder) Encode(p *client.Point, precision string) []string {
+	line := p.PrecisionString(precision)
+	if !e.nanos || p.Time().IsZero() {
+		return []string{line}
+	}
+	// Timestamp is the last element of a line, it has no spaces
+	mult := models.GetPrecisionMultiplier(precision)
+	ts := p.UnixNano() / mult * mult
+	return []string{line[:strings.LastIndexByte(line, ' ')+1] + strconv.FormatInt(ts, 10)}
+}
+
+// GraphiteEncoder returns encoder of Graphite plaintext protocol with tags.
+// Every numeric field becomes a separate line
+// "prefix.measurement.field;tag=value value timestamp" with timestamp in
+// seconds. Boolean fields are written as 0 and 1, string and non-finite
+// fields are skipped.
+func GraphiteEncoder(prefix string) Encoder {
+	return graphiteEncoder{prefix: prefix}
+}
+
+// graphiteEncoder is an encoder created by GraphiteEncoder().
+type graphiteEncoder struct {
+	prefix string
+}
+
+// graphiteReplacer replaces characters not allowed in Graphite paths and tags.
+var graphiteReplacer = strings.NewReplacer(" ", "_", ";", "_", "=", "_", "~", "_")
+
+// Encode returns a line of each numeric field of a point.
+func (e graphiteEncoder) Encode(p *client.Point, _ string) []string {
+	fields, err := p.Fields()
+	if err != nil {
+		return nil
+	}
+	tags := p.Tags()
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		// Graphite does not allow empty tag values
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var suffix strings.Builder
+	for _, k := range keys {
+		suffix.WriteString(";" + graphiteReplacer.Replace(k) + "=" + graphiteReplacer.Replace(tags[k]))
+	}
+	// Carbon replaces timestamp -1 with the time of receiving
+	ts := "-1"
+	if !p.Time().IsZero() {
+		ts = strconv.FormatInt(p.Time().Unix(), 10)
+	}
+
+	path := graphiteReplacer.Replace(e.prefix + p.Name())
+	lines := make([]string, 0, len(fields))
+	for field, value := range fields {
+		v, ok := graphiteValue(value)
+		if !ok {
+			continue
+		}
+		lines = append(lines, path+"."+graphiteReplacer.Replace(field)+suffix.String()+" "+v+" "+ts)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// graphiteValue formats numeric field value, ok is false for other values.
+func graphiteValue(value interface{}) (s string, ok bool) {
+	switch v := value.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case uint64:
+		return strconv.FormatUint(v, 10), true
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "", false
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64), true
+	case bool:
+		if v {
+			return "1", true
+		}
+		return "0", true
+	}
+	return "", false
+}
@@ -0,0 +1,172 @@
+package influx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	client "github.com/influxdata/influxdb/client/v2"
+)
+
+// Endpoint is an additional influx DB server data points are written to.
+type Endpoint struct {
+	// URL of influx DB server, it may include credentials.
+	URL string
+	// Database overrides database of written data points if not empty.
+	Database string
+}
+
+// EndpointMode selects how data points are written to multiple endpoints.
+type EndpointMode int
+
+const (
+	// Fanout writes every batch of data points to all endpoints. Write
+	// fails if any of the endpoints fails, retries are written only to the
+	// failed endpoints. Errors of some endpoints, even authorization ones,
+	// do not stop Run() while other endpoints accept the data.
+	Fanout EndpointMode = iota
+	// Failover writes every batch to the first endpoint that accepts it,
+	// trying endpoints in order. Write fails only if all endpoints fail.
+	Failover
+)
+
+// endpointClient is an influx client of a single endpoint.
+type endpointClient struct {
+	client.Client
+	database string
+}
+
+// multiClient is an influx client writing data points to several endpoints.
+type multiClient struct {
+	clients []endpointClient
+	mode    EndpointMode
+
+	// mu guards endpoints that accepted the last written batch, retries of
+	// the same batch are written only to endpoints that failed.
+	mu        sync.Mutex
+	last      client.BatchPoints
+	delivered []bool
+}
+
+// endpointsError is returned when writing to some of the endpoints fails.
+type endpointsError struct {
+	failed int
+	total  int
+	// partial is set if at least one endpoint accepted the batch
+	partial bool
+	first   error
+}
+
+func (e *endpointsError) Error() string {
+	return fmt.Sprintf("%d of %d endpoints failed, %v", e.failed, e.total, e.first)
+}
+
+func (e *endpointsError) Unwrap() error { return e.first }
+
+// partialWrite reports whether err is caused by some of the endpoints while
+// the others accepted the batch. Such error is never terminal, otherwise a
+// single misconfigured endpoint would stop reporting to the healthy ones.
+func partialWrite(err error) bool {
+	var ee *endpointsError
+	return errors.As(err, &ee) && ee.partial
+}
+
+// Ping pings all endpoints and returns response of the first one that
+// succeeded.
+func (c *multiClient) Ping(timeout time.Duration) (time.Duration, string, error) {
+	var err error
+	for _, ec := range c.clients {
+		var rtt time.Duration
+		var version string
+		if rtt, version, err = ec.Ping(timeout); err == nil {
+			return rtt, version, nil
+		}
+	}
+	return 0, "", err
+}
+
+// Write writes a batch of data points to endpoints according to the mode. In
+// fanout mode a retried batch is written only to endpoints that failed.
+func (c *multiClient) Write(bp client.BatchPoints) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mode == Fanout && bp != c.last {
+		c.last = bp
+		c.delivered = make([]bool, len(c.clients))
+	}
+
+	var first error
+	failed := 0
+	for i, ec := range c.clients {
+		if c.mode == Fanout && c.delivered[i] {
+			continue
+		}
+		err := ec.write(bp)
+		if err == nil {
+			if c.mode == Failover {
+				return nil
+			}
+			c.delivered[i] = true
+			continue
+		}
+		failed++
+		if first == nil {
+			first = fmt.Errorf("endpoint %d: %w", i, err)
+		}
+	}
+	if failed == 0 {
+		return nil
+	}
+	return &endpointsError{
+		failed:  failed,
+		total:   len(c.clients),
+		partial: failed < len(c.clients),
+		first:   first,
+	}
+}
+
+// write writes a batch overriding its database if endpoint has one set.
+func (ec endpointClient) write(bp client.BatchPoints) error {
+	if ec.database == "" || ec.database == bp.Database() {
+		return ec.Write(bp)
+	}
+	override, err := client.NewBatchPoints(client.BatchPointsConfig{
+		Database:         ec.database,
+		RetentionPolicy:  bp.RetentionPolicy(),
+		Precision:        bp.Precision(),
+		WriteConsistency: bp.WriteConsistency(),
+	})
+	if err != nil {
+		return err
+	}
+	override.AddPoints(bp.Points())
+	return ec.Write(override)
+}
+
+// Query queries the first endpoint.
+func (c *multiClient) Query(q client.Query) (*client.Response, error) {
+	return c.clients[0].Query(q)
+}
+
+// QueryCtx queries the first endpoint.
+func (c *multiClient) QueryCtx(ctx context.Context, q client.Query) (*client.Response, error) {
+	return c.clients[0].QueryCtx(ctx, q)
+}
+
+// QueryAsChunk queries the first endpoint.
+func (c *multiClient) QueryAsChunk(q client.Query) (*client.ChunkedResponse, error) {
+	return c.clients[0].QueryAsChunk(q)
+}
+
+// Close closes clients of all endpoints.
+func (c *multiClient) Close() error {
+	var err error
+	for _, ec := range c.clients {
+		if cerr := ec.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+package influx
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// Errors returned when writing data points to influx DB fails. Every write
+// error matches ErrWrite, errors caused by rejected credentials and by failed
+// connections additionally match ErrAuth and ErrConnection. Use errors.Is()
+// to check the cause.
+var (
+	ErrWrite      = errors.New("influx write failed")
+	ErrAuth       = errors.New("influx authorization failed")
+	ErrConnection = errors.New("influx connection failed")
+)
+
+// authErrors lists influx DB error messages caused by invalid credentials.
+var authErrors = []string{
+	"authorization failed",
+	"unable to parse authentication credentials",
+}
+
+// writeError wraps an error returned by influx client and classifies it. It
+// also describes the failed batch for logging.
+type writeError struct {
+	err   error
+	cause error
+	dest  destination
+	// points is a number of data points in the failed batch
+	points int
+	// measurement is a measurement rejected by influx DB, if known
+	measurement string
+}
+
+// newWriteError wraps an error returned by influx client write of a batch.
+func newWriteError(err error, dest destination, points int) error {
+	return &writeError{
+		err:         err,
+		cause:       errorCause(err),
+		dest:        dest,
+		points:      points,
+		measurement: rejectedMeasurement(err.Error()),
+	}
+}
+
+// errorCause classifies an error returned by influx client, it returns
+// ErrAuth, ErrConnection or nil if the cause is not known.
+func errorCause(err error) error {
+	msg := err.Error()
+	for _, auth := range authErrors {
+		if strings.Contains(msg, auth) {
+			return ErrAuth
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return ErrConnection
+	}
+	return nil
+}
+
+// rejectedMeasurement extracts measurement name from influx DB error message,
+// e.g. partial write error caused by field type conflict.
+func rejectedMeasurement(msg string) string {
+	// Error messages are JSON encoded response bodies with escaped quotes
+	msg = strings.ReplaceAll(msg, `\"`, `"`)
+	const prefix = `measurement "`
+	i := strings.Index(msg, prefix)
+	if i < 0 {
+		return ""
+	}
+	msg = msg[i+len(prefix):]
+	if i = strings.IndexByte(msg, '"'); i < 0 {
+		return ""
+	}
+	return msg[:i]
+}
+
+// logFields returns details of the failed write as alternating keys and
+// values.
+func (e *writeError) logFields() []interface{} {
+	fields := []interface{}{
+		"database", e.dest.database,
+		"rp", e.dest.rp,
+		"points", e.points,
+	}
+	if e.measurement != "" {
+		fields = append(fields, "measurement", e.measurement)
+	}
+	return fields
+}
+
+func (e *writeError) Error() string { return e.err.Error() }
+func (e *writeError) Unwrap() error { return e.err }
+
+// Is reports whether error matches ErrWrite or its cause.
+func (e *writeError) Is(target error) bool {
+	return target == ErrWrite || (e.cause != nil && target == e.cause)
+}
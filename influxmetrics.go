@@ -3,10 +3,23 @@ package influx
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	client "github.com/influxdata/influxdb/client/v2"
 	metrics "github.com/rcrowley/go-metrics"
@@ -16,243 +29,2452 @@ import (
 // Reporter holds configuration of go-metrics influx exporter. It can be
 // configured only be public setter methods.
 type Reporter struct {
-	registry  metrics.Registry
-	interval  time.Duration
-	url       string
-	database  string
-	tags      map[string]string
-	precision string
-	ctx       context.Context
-	log       logrus.FieldLogger
+	registry         metrics.Registry
+	registries       []metrics.Registry
+	interval         time.Duration
+	jitter           float64
+	url              string
+	endpoints        []Endpoint
+	endpointMode     EndpointMode
+	database         string
+	rp               string
+	databaseFunc     func(name string) (db, rp string)
+	defaultDBFunc    func() (db, rp string)
+	tags             map[string]string
+	dynamicTags      func() map[string]string
+	strictTags       bool
+	hostTag          string
+	versionTag       string
+	clock            func() time.Time
+	precision        string
+	precisionFunc    func(name string) string
+	timeout          time.Duration
+	shutdownTimeout  time.Duration
+	ping             bool
+	pingRequired     bool
+	proxy            func(*http.Request) (*url.URL, error)
+	dial             func(ctx context.Context, network, addr string) (net.Conn, error)
+	tls              *tls.Config
+	batchSize        uint
+	retries          uint
+	retryInterval    time.Duration
+	maxRetryInterval time.Duration
+	maxRetryTime     time.Duration
+	output           io.Writer
+	udpAddr          string
+	udpPayloadSize   int
+	sinkNetwork      string
+	sinkAddr         string
+	encoder          Encoder
+	shared           client.Client
+	runtimeInterval  time.Duration
+	flush            time.Duration
+	bufferLimit      uint
+	ctx              context.Context
+	log              Logger
+	onError          func(err error)
+
+	// percentiles is computed once by Percentiles() and shared by all
+	// histograms and timers, go-metrics snapshots do not retain it.
+	percentiles     []float64
+	percentileNames []string
+	sampleSize      bool
+	sum             bool
+	counterDiff     bool
+	counterRate     bool
+	counterReset    CounterResetMode
+	diffField       string
+	skipEmpty       bool
+	skipGauges      bool
+	gaugeRefresh    uint
+	meterDiff       bool
+	flattenStats    bool
+	meterFields     map[string]bool
+	dropFields      map[string]bool
+	fieldSets       map[string]map[string]bool
+	fieldNames      map[string]string
+	nonFinite       *float64
+	epochField      string
+	forceFloat      bool
+	prefix          string
+	nameCase        CaseMode
+	nameTag         string
+	typeTag         string
+	heartbeat       string
+	seqField        string
+	selfMetrics     string
+	measurementFunc func(name string) (string, map[string]string)
+	include         []*regexp.Regexp
+	exclude         []*regexp.Regexp
+	maxPoints       uint
+	seriesLimit     uint
+	priority        []*regexp.Regexp
+
+	// stop is closed by Close() to stop Run() loop, done is closed when
+	// Run() returns. client and errQueue are set while Run() is active.
+	stop     chan struct{}
+	stopOnce sync.Once
+	runMu    sync.Mutex
+	done     chan struct{}
+	finalErr error
+	client   client.Client
+	errQueue chan error
+
+	// mu serializes report passes and guards state kept between them.
+	mu          sync.Mutex
+	lastCounter map[string]counterState
+	lastMeter   map[string]int64
+	lastGauge   map[string]gaugeState
+	seq         int64
+	entries     []registryEntry
+	emptyTags   map[string]bool
+	nanWarned   map[string]bool
+	pending     map[destination][]*client.Point
+	stats       reporterStats
+
+	// envOnce resolves envTags once, they are used without holding mu by
+	// WriteEvent().
+	envOnce sync.Once
+	envTags map[string]string
+
+	// statusMu guards result of the last write and series count of the last
+	// report, it is separate from mu to not block accessors while a write is
+	// in progress.
+	statusMu   sync.Mutex
+	lastReport time.Time
+	lastError  error
+	series     int
+	lastFlush  time.Time
+}
+
+// NewReporter creates a new instance of influx metrcs reporter. It may be
+// further configured with helper methods. It will not start exporting metrics
+// until Run() is called. Nil registry is replaced with metrics.DefaultRegistry.
+func NewReporter(registry metrics.Registry, interval time.Duration, url string, db string) *Reporter {
+	if registry == nil {
+		registry = metrics.DefaultRegistry
+	}
+	r := &Reporter{
+		registry:         registry,
+		interval:         interval,
+		url:              url,
+		database:         db,
+		tags:             nil,
+		precision:        "s",
+		timeout:          10 * time.Second,
+		shutdownTimeout:  5 * time.Second,
+		retryInterval:    time.Second,
+		maxRetryInterval: 30 * time.Second,
+		clock:            time.Now,
+		ctx:              context.Background(),
+		log:              nopLogger{},
+		measurementFunc:  parseName,
+		counterDiff:      true,
+		stop:             make(chan struct{}),
+		lastCounter:      make(map[string]counterState),
+		lastMeter:        make(map[string]int64),
+		lastGauge:        make(map[string]gaugeState),
+		emptyTags:        make(map[string]bool),
+		nanWarned:        make(map[string]bool),
+	}
+	return r.Percentiles([]float64{0.5, 0.75, 0.95, 0.99, 0.999, 0.9999})
+}
+
+// Jitter randomizes intervals between reports by up to a given fraction of
+// report interval in both directions, e.g. 0.1 makes intervals of 10 second
+// reporter last between 9 and 11 seconds. It prevents many instances started
+// at the same time from writing to influx DB simultaneously. Fraction is
+// clamped to [0, 0.9] range.
+func (r *Reporter) Jitter(fraction float64) *Reporter {
+	r.jitter = math.Max(0, math.Min(fraction, 0.9))
+	return r
+}
+
+// Registries adds registries exported in addition to the one passed to
+// NewReporter(). All registries are exported using the same influx client.
+// Metric names must be unique across registries, otherwise their data points
+// end up in the same influx series.
+func (r *Reporter) Registries(registries ...metrics.Registry) *Reporter {
+	r.registries = registries
+	return r
+}
+
+// Tags sets a set of tags that will be assiciated with each influx data point
+// written by this exporter.
+func (r *Reporter) Tags(tags map[string]string) *Reporter {
+	r.tags = tags
+	return r
+}
+
+// HostnameTag adds a tag with a given key holding host name of the machine.
+// Empty key defaults to "host". Host name is resolved once by the first
+// report, if it can not be resolved the error is logged and the tag is not
+// added. Tags set by Tags() take precedence.
+func (r *Reporter) HostnameTag(key string) *Reporter {
+	if key == "" {
+		key = "host"
+	}
+	r.hostTag = key
+	return r
+}
+
+// VersionTag adds a tag with a given key holding version of the main module
+// read from build info, or VCS revision if the module version is not known.
+// Empty key defaults to "version". Version is resolved once by the first
+// report, if build info is not available (e.g. for "go run") a warning is
+// logged and the tag is not added. Tags set by Tags() take precedence.
+func (r *Reporter) VersionTag(key string) *Reporter {
+	if key == "" {
+		key = "version"
+	}
+	r.versionTag = key
+	return r
+}
+
+// environmentTags returns tags enabled by HostnameTag() and VersionTag(). They
+// are resolved once.
+func (r *Reporter) environmentTags() map[string]string {
+	r.envOnce.Do(func() {
+		r.envTags = make(map[string]string)
+		if r.hostTag != "" {
+			if host, err := os.Hostname(); err != nil {
+				r.logError("resolving host name", "error", err)
+			} else {
+				r.envTags[r.hostTag] = host
+			}
+		}
+		if r.versionTag != "" {
+			if version := buildVersion(); version == "" {
+				r.logWarn("build info does not have main module version")
+			} else {
+				r.envTags[r.versionTag] = version
+			}
+		}
+	})
+	return r.envTags
+}
+
+// StrictTags makes empty tag keys and values an error. Influx DB silently drops
+// such tags, so series that differ only by an empty tag are merged into one.
+// By default reporter logs a warning and writes the data anyway. In strict
+// mode Validate() rejects empty static tags and metrics with empty tags
+// extracted from their names are not reported.
+func (r *Reporter) StrictTags() *Reporter {
+	r.strictTags = true
+	return r
+}
+
+// DynamicTags sets a function returning tags that may change during process
+// lifetime (e.g. leader election role). It is called once per report and
+// returned tags are merged on top of tags set by Tags(). Tags extracted from
+// metric names take precedence over dynamic tags.
+func (r *Reporter) DynamicTags(f func() map[string]string) *Reporter {
+	r.dynamicTags = f
+	return r
+}
+
+// Clock sets a function returning timestamps of reported data points. By
+// default current time is used. It is useful for deterministic tests and for
+// backfilling metrics with controlled timestamps. Report and flush intervals
+// are always measured in wall time.
+func (r *Reporter) Clock(clock func() time.Time) *Reporter {
+	r.clock = clock
+	return r
+}
+
+// RetentionPolicy sets retention policy data points are written to. By default
+// database default retention policy is used.
+func (r *Reporter) RetentionPolicy(rp string) *Reporter {
+	r.rp = rp
+	return r
+}
+
+// DatabaseFunc sets a function choosing database and retention policy for
+// each metric by its name. It can be used to keep high cardinality metrics in
+// a database or retention policy with shorter retention. If the function
+// returns empty database name default database and retention policy are used.
+// Writes to a database returned by the function that does not exist yet are
+// logged and do not stop Run() or writes to other databases.
+func (r *Reporter) DatabaseFunc(f func(name string) (db, rp string)) *Reporter {
+	r.databaseFunc = f
+	return r
+}
+
+// DefaultDatabaseFunc sets a function resolving default database and
+// retention policy. It is called once at the start of every report, so the
+// target can be changed at runtime without restarting the reporter. If the
+// function returns empty database name database and retention policy given
+// at construction time are used. Same as with DatabaseFunc(), missing database
+// returned by the function does not stop Run().
+func (r *Reporter) DefaultDatabaseFunc(f func() (db, rp string)) *Reporter {
+	r.defaultDBFunc = f
+	return r
+}
+
+// Precision changes the timestamp precision used in reported data points. By
+// default timestamps are reported with a seconds precision. Having higher than
+// seconds precision should be useful only when export interval is less
+// than a second.
+func (r *Reporter) Precision(precision string) *Reporter {
+	r.precision = precision
+	return r
+}
+
+// PrecisionFunc sets a function choosing timestamp precision for each metric by
+// its name, overriding precision set by Precision(). It can be used to report
+// high frequency timers with a finer precision than the rest of metrics. If
+// the function returns empty string default precision is used.
+func (r *Reporter) PrecisionFunc(f func(name string) string) *Reporter {
+	r.precisionFunc = f
+	return r
+}
+
+// HTTPTimeout sets timeout of HTTP requests made to influx DB. By default
+// 10 second timeout is used. Zero value disables the timeout.
+func (r *Reporter) HTTPTimeout(timeout time.Duration) *Reporter {
+	r.timeout = timeout
+	return r
+}
+
+// ShutdownTimeout limits how long reporter waits for the final export of
+// metrics when it is stopped. Run() and Close() return after the timeout even
+// if the write is still in progress. By default 5 second timeout is used, zero
+// value waits for the final export to finish.
+func (r *Reporter) ShutdownTimeout(timeout time.Duration) *Reporter {
+	r.shutdownTimeout = timeout
+	return r
+}
+
+// Endpoints sets additional influx DB servers data points are written to. The
+// server given to NewReporter() is the primary one and is always tried
+// first. Mode selects whether every batch is written to all servers or only to
+// the first one accepting it. HTTP options apply to all servers.
+func (r *Reporter) Endpoints(mode EndpointMode, endpoints []Endpoint) *Reporter {
+	r.endpointMode = mode
+	r.endpoints = endpoints
+	return r
+}
+
+// PingOnStart makes Run() ping influx DB once before the first report, so
+// misconfigured URL is reported immediately. Failed ping is logged, if
+// required is true Run() also returns the error. Note that influx DB does not
+// check credentials of ping requests by default.
+func (r *Reporter) PingOnStart(required bool) *Reporter {
+	r.ping = true
+	r.pingRequired = required
+	return r
+}
+
+// Proxy sets a function returning proxy URL for HTTP requests made to influx
+// DB, for example http.ProxyFromEnvironment. By default proxy is not used.
+func (r *Reporter) Proxy(proxy func(*http.Request) (*url.URL, error)) *Reporter {
+	r.proxy = proxy
+	return r
+}
+
+// DialContext sets a custom dial function used by HTTP transport to create
+// unencrypted TCP connections to influx DB.
+func (r *Reporter) DialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *Reporter {
+	r.dial = dial
+	return r
+}
+
+// TLSConfig sets TLS configuration used for HTTPS connections to influx DB. It
+// can be used to trust a custom root CA pool or to disable certificate
+// verification (InsecureSkipVerify) for development environments.
+func (r *Reporter) TLSConfig(config *tls.Config) *Reporter {
+	r.tls = config
+	return r
+}
+
+// BatchSize limits number of data points written to influx DB in a single
+// HTTP request. By default (or when set to zero) all points of a report are
+// written in a single request.
+func (r *Reporter) BatchSize(size uint) *Reporter {
+	r.batchSize = size
+	return r
+}
+
+// Retries sets how many times a failed write is retried before data points are
+// dropped. Writes rejected because of reporter misconfiguration (e.g.
+// authorization failure) are not retried. By default writes are not retried.
+// Retries delay the next report, so RetryInterval, MaxRetryInterval and
+// MaxRetryTime should be tuned together with report interval.
+func (r *Reporter) Retries(retries uint) *Reporter {
+	r.retries = retries
+	return r
+}
+
+// RetryInterval sets delay before the first retry of a failed write. Delay is
+// doubled after each retry. Default retry interval is 1 second.
+func (r *Reporter) RetryInterval(interval time.Duration) *Reporter {
+	r.retryInterval = interval
+	return r
+}
+
+// MaxRetryInterval limits delay between retries of a failed write. Default
+// maximum retry interval is 30 seconds, zero value disables the limit.
+func (r *Reporter) MaxRetryInterval(interval time.Duration) *Reporter {
+	r.maxRetryInterval = interval
+	return r
+}
+
+// MaxRetryTime limits total time spent writing a single batch including
+// retries. By default only the number of retries is limited.
+func (r *Reporter) MaxRetryTime(d time.Duration) *Reporter {
+	r.maxRetryTime = d
+	return r
+}
+
+// FlushInterval sets how often collected data points are written to influx DB.
+// By default points are written on every report interval. Setting flush
+// interval longer than report interval buffers points of several reports and
+// writes them together. Buffered points are always written when reporter is
+// stopped.
+func (r *Reporter) FlushInterval(interval time.Duration) *Reporter {
+	r.flush = interval
+	return r
+}
+
+// Output makes reporter write data points in line protocol format to w instead
+// of sending them to influx DB. It is useful for debugging and for testing how
+// metrics are mapped to influx measurements, tags and fields. Output is
+// deterministic, fields and lines of each batch are sorted.
+func (r *Reporter) Output(w io.Writer) *Reporter {
+	r.output = w
+	return r
+}
+
+// UDP makes reporter write data points in line protocol format to influx DB
+// UDP listener at addr (host:port) instead of using HTTP API. Points are
+// split into packets of at most payloadSize bytes, zero selects 512 bytes that
+// fit into MTU of most networks. Database and retention policy of the
+// listener are configured on the server. Timestamps are rounded to precision
+// but always sent in nanoseconds. Delivery is not confirmed, lost packets are
+// silently dropped.
+func (r *Reporter) UDP(addr string, payloadSize int) *Reporter {
+	r.udpAddr = addr
+	r.udpPayloadSize = payloadSize
+	return r
+}
+
+// LineProtocolSink makes reporter write data points in line protocol format
+// to a TCP or Unix stream socket instead of influx DB, e.g. to a local
+// Telegraf socket listener which buffers and forwards them. Network is "tcp",
+// "tcp4", "tcp6" or "unix". If network is empty, address is parsed as URL,
+// e.g. "unix:///var/run/telegraf.sock" or "tcp://localhost:8094". Timestamps
+// are truncated to precision but always written in nanoseconds. Connection is
+// established on the first write and re-established after a failed one,
+// HTTPTimeout() limits dialing and writing.
+func (r *Reporter) LineProtocolSink(network, address string) *Reporter {
+	r.sinkNetwork = network
+	r.sinkAddr = address
+	return r
+}
+
+// Encoder sets encoder of data points written by Output() and
+// LineProtocolSink(). By default influx line protocol is used. Metrics are
+// mapped to data points the same way regardless of encoder, e.g.
+// GraphiteEncoder() can be used with a Graphite socket sink to ship metrics to
+// Graphite during migration.
+func (r *Reporter) Encoder(e Encoder) *Reporter {
+	r.encoder = e
+	return r
+}
+
+// Client sets influx client used to write data points instead of creating a
+// new one from reporter URL. It allows sharing a single client between
+// reporter and the rest of the application. Reporter never closes this client,
+// its lifecycle is owned by the caller.
+func (r *Reporter) Client(c client.Client) *Reporter {
+	r.shared = c
+	return r
+}
+
+// RuntimeMetrics enables reporting of Go runtime metrics (memory, GC pauses,
+// goroutines count). Metrics are registered in reporter registry with
+// "runtime." prefix when Run() starts and are updated every interval until
+// Run() returns. go-metrics keeps runtime metrics in global variables, so it
+// should be enabled only for a single running reporter.
+func (r *Reporter) RuntimeMetrics(interval time.Duration) *Reporter {
+	r.runtimeInterval = interval
+	return r
+}
+
+// BufferLimit limits number of data points buffered between flushes when flush
+// interval is longer than report interval. Points collected after the limit is
+// reached are dropped with a logged warning. By default buffer is not limited.
+func (r *Reporter) BufferLimit(limit uint) *Reporter {
+	r.bufferLimit = limit
+	return r
+}
+
+// PerfConfig bundles settings affecting write throughput. Zero fields keep
+// current values, see setters of the same name for details. Compression is
+// not available, influx v1 client does not support it.
+type PerfConfig struct {
+	// BatchSize limits number of data points written per request. By
+	// default all points of a report are written in one request.
+	BatchSize uint
+	// FlushInterval buffers data points and writes them at most once per
+	// interval. By default points are written on every report.
+	FlushInterval time.Duration
+	// BufferLimit caps number of buffered data points. Unlimited by
+	// default.
+	BufferLimit uint
+	// Retries is a number of retries of a failed write. Not retried by
+	// default.
+	Retries uint
+	// RetryInterval is a delay before the first retry, 1 second by
+	// default.
+	RetryInterval time.Duration
+}
+
+// Performance applies throughput related settings at once. Individual setters
+// can still be used to change them later.
+func (r *Reporter) Performance(conf PerfConfig) *Reporter {
+	if conf.BatchSize > 0 {
+		r.BatchSize(conf.BatchSize)
+	}
+	if conf.FlushInterval > 0 {
+		r.FlushInterval(conf.FlushInterval)
+	}
+	if conf.BufferLimit > 0 {
+		r.BufferLimit(conf.BufferLimit)
+	}
+	if conf.Retries > 0 {
+		r.Retries(conf.Retries)
+	}
+	if conf.RetryInterval > 0 {
+		r.RetryInterval(conf.RetryInterval)
+	}
+	return r
+}
+
+// Percentiles sets which percentiles are reported for histograms, timers and
+// samples. Each percentile must be in the [0, 1] range, values outside of it
+// and duplicates are ignored. Field names are derived from the percentile
+// value, for example 0.9 is reported as "p90" and 0.999 as "p999". Passing an
+// empty slice disables percentile reporting. By default p50, p75, p95, p99,
+// p999 and p9999 are reported.
+func (r *Reporter) Percentiles(percentiles []float64) *Reporter {
+	r.percentiles = nil
+	r.percentileNames = nil
+	seen := make(map[string]bool)
+	for _, p := range percentiles {
+		// Negated check also skips NaN
+		if !(p >= 0 && p <= 1) {
+			continue
+		}
+		name := percentileName(p)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		r.percentiles = append(r.percentiles, p)
+		r.percentileNames = append(r.percentileNames, name)
+	}
+	return r
+}
+
+// percentileName returns a field name for a percentile in the [0, 1] range.
+// Name consists of "p" followed by at least two digits of percent value with
+// the decimal point removed, this keeps names of distinct percentiles unique
+// (0.05 is "p05", 0.5 is "p50", 0.999 is "p999").
+func percentileName(p float64) string {
+	if p == 1 {
+		return "p100"
+	}
+	digits := strings.TrimPrefix(strconv.FormatFloat(p, 'f', -1, 64), "0.")
+	if len(digits) < 2 {
+		digits += "0"
+	}
+	return "p" + digits
+}
+
+// SampleSize enables reporting of "sample_size" field for histograms and
+// samples. It holds number of values in the reservoir sample percentiles are
+// computed from, which may be much smaller than the total "count". Timers do
+// not expose their sample, so the field is not reported for them.
+func (r *Reporter) SampleSize() *Reporter {
+	r.sampleSize = true
+	return r
+}
+
+// SumField enables reporting of "sum" field for histograms, timers and
+// samples, so averages over arbitrary time ranges can be computed from
+// differences of sum and count. go-metrics does not keep a true total of
+// recorded values, sum is computed as count multiplied by mean of the sample.
+// It is exact until count exceeds sample reservoir size and an estimate
+// afterwards.
+func (r *Reporter) SumField() *Reporter {
+	r.sum = true
+	return r
+}
+
+// CounterDiff enables or disables reporting of counter "diff" field holding
+// counter change since the last report. Diff is negative if counter was
+// decremented or cleared. It is enabled by default. Disabling it
+// also removes per counter state kept by the reporter unless CounterRate() is
+// enabled.
+func (r *Reporter) CounterDiff(enabled bool) *Reporter {
+	r.counterDiff = enabled
+	return r
+}
+
+// CounterResetMode selects how counter "diff" and "rate" fields are computed
+// when counter value decreases since the last report.
+type CounterResetMode int
+
+const (
+	// SignedDelta reports a negative change, e.g. 10 followed by 7
+	// gives diff -3. It suits counters that are decremented on purpose.
+	SignedDelta CounterResetMode = iota
+	// DecreaseIsReset treats decrease as counter reset, the new value is the
+	// change since the reset, e.g. 10 followed by 7 gives diff 7.
+	DecreaseIsReset
+	// ClampToZero reports no change on decrease, e.g. 10 followed by 7
+	// gives diff 0.
+	ClampToZero
+)
+
+// CounterReset sets how counter decrease is reported in "diff" and "rate"
+// fields. By default signed change is reported.
+func (r *Reporter) CounterReset(mode CounterResetMode) *Reporter {
+	r.counterReset = mode
+	return r
+}
+
+// CounterDiffField renames counter "diff" field. Unlike FieldNames() it does
+// not rename "diff" field of meters.
+func (r *Reporter) CounterDiffField(name string) *Reporter {
+	r.diffField = name
+	return r
+}
+
+// CounterRate enables reporting of counter "rate" field holding per second
+// change since the last report. It is computed using actual time elapsed
+// between reports of the counter, not the nominal report interval, so it stays
+// accurate when reports are delayed. Rate is not reported for the first time
+// counter is seen.
+func (r *Reporter) CounterRate(enabled bool) *Reporter {
+	r.counterRate = enabled
+	return r
+}
+
+// MonotonicCounters makes reporter write counters as plain cumulative values
+// with only the "count" field. No per counter state is kept by the reporter,
+// changes can be computed at query time with difference() or
+// non_negative_derivative() functions. It is the same as CounterDiff(false)
+// followed by CounterRate(false).
+func (r *Reporter) MonotonicCounters() *Reporter {
+	return r.CounterDiff(false).CounterRate(false)
+}
+
+// SkipEmpty makes reporter skip counters, histograms, meters, timers and
+// samples with zero count. Gauges are always reported as zero is a meaningful
+// gauge value.
+func (r *Reporter) SkipEmpty() *Reporter {
+	r.skipEmpty = true
+	return r
+}
+
+// SkipUnchangedGauges makes reporter skip gauges with the same value as the
+// last written one. It reduces number of data points for slowly changing
+// gauges, such as configuration values or capacity limits. If refresh is not
+// zero unchanged gauge is still written at least once every refresh reports,
+// so the series does not look dead to queries with a limited time range. All
+// gauges are written again after a failed write or dropped data points.
+func (r *Reporter) SkipUnchangedGauges(refresh uint) *Reporter {
+	r.skipGauges = true
+	r.gaugeRefresh = refresh
+	return r
+}
+
+// MeterDiff enables reporting of meter "diff" field holding number of events
+// marked since the last report. Unlike rate fields it is not smoothed, so it
+// gives exact per interval event counts. It is disabled by default.
+func (r *Reporter) MeterDiff(enabled bool) *Reporter {
+	r.meterDiff = enabled
+	return r
+}
+
+// meterFieldNames lists all fields reported for meters.
+var meterFieldNames = []string{"count", "diff", "m1", "m5", "m15", "mean"}
+
+// MeterFields limits which fields are reported for meters. Known field names
+// are "count", "diff", "m1", "m5", "m15" and "mean", unknown names are
+// reported by Validate(). By default all meter fields are reported. If none of
+// the fields are selected meters are not reported at all.
+func (r *Reporter) MeterFields(fields []string) *Reporter {
+	r.meterFields = make(map[string]bool)
+	for _, field := range fields {
+		r.meterFields[field] = true
+	}
+	return r
+}
+
+// FlattenStats makes reporter write every statistic of histograms, samples,
+// meters and timers as a separate measurement with a single "value" field.
+// Statistic name is appended to the measurement name after a dot, for example
+// "latency.p99" and "latency.mean". It matches schemas migrated from Graphite
+// where each statistic is a separate series.
+func (r *Reporter) FlattenStats() *Reporter {
+	r.flattenStats = true
+	return r
+}
+
+// DropFields removes fields with given default names (e.g. "variance",
+// "stddev") from data points of all metric types. Metrics with all fields
+// dropped are not reported.
+func (r *Reporter) DropFields(fields ...string) *Reporter {
+	r.dropFields = make(map[string]bool, len(fields))
+	for _, field := range fields {
+		r.dropFields[field] = true
+	}
+	return r
+}
+
+// FieldSet limits fields reported for metrics of a given type to the listed
+// default field names. Types are the same as values of TypeTag(). Unknown
+// types and field names are reported by Validate(). Metrics with no fields
+// left are not reported.
+func (r *Reporter) FieldSet(kind string, fields ...string) *Reporter {
+	if r.fieldSets == nil {
+		r.fieldSets = make(map[string]map[string]bool)
+	}
+	set := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		set[field] = true
+	}
+	r.fieldSets[kind] = set
+	return r
+}
+
+// knownFields returns default names of fields reported for a given metric
+// type or nil if the type is unknown.
+func (r *Reporter) knownFields(kind string) []string {
+	distribution := append([]string{"count", "max", "mean", "min", "stddev", "sum", "variance"}, r.percentileNames...)
+	switch kind {
+	case "counter":
+		return []string{"count", "diff", "rate"}
+	case "gauge":
+		return []string{"value"}
+	case "histogram", "sample":
+		return append(distribution, "sample_size")
+	case "timer":
+		return append(distribution, "m1", "m5", "m15", "meanrate")
+	case "meter":
+		return meterFieldNames
+	case "healthcheck":
+		return []string{"healthy", "error"}
+	}
+	return nil
+}
+
+// FieldNames sets custom names for reported fields. Map keys are default field
+// names (e.g. "count", "value", "p99") and values are names to use instead.
+// Fields not present in the map keep their default names. It can be used to
+// write metrics to an existing influx DB schema.
+func (r *Reporter) FieldNames(names map[string]string) *Reporter {
+	r.fieldNames = names
+	return r
+}
+
+// NonFiniteValue sets a value written instead of NaN and infinite float
+// field values (e.g. a gauge ratio with zero denominator or a mean of an empty
+// sample). Such values are not supported by influx DB and by default fields
+// holding them are skipped, a warning is logged once per metric.
+func (r *Reporter) NonFiniteValue(val float64) *Reporter {
+	r.nonFinite = &val
+	return r
+}
+
+// EpochField adds an integer field with a given key holding point timestamp as
+// milliseconds since Unix epoch. It is written in addition to the regular
+// point timestamp, for dashboards that query time from a field. With
+// FlattenStats() it is added to the point of every statistic.
+func (r *Reporter) EpochField(key string) *Reporter {
+	r.epochField = key
+	return r
+}
+
+// ForceFloatFields makes reporter write all numeric fields as floats. Influx DB
+// rejects writes changing field type of an existing series, this keeps field
+// types stable when e.g. a gauge is changed from integer to float.
+func (r *Reporter) ForceFloatFields() *Reporter {
+	r.forceFloat = true
+	return r
+}
+
+// MeasurementPrefix sets a prefix prepended to measurement name of every data
+// point. Prefix is added after tag pairs are extracted from metric name, so
+// metric "hits,region=eu" with prefix "svc_" creates "svc_hits" measurement.
+func (r *Reporter) MeasurementPrefix(prefix string) *Reporter {
+	r.prefix = prefix
+	return r
+}
+
+// MeasurementFunc sets a function that translates metric name to influx
+// measurement name and tags, replacing default parsing of tag pairs from metric
+// name. Returned tags are merged on top of tags set by Tags().
+func (r *Reporter) MeasurementFunc(f func(name string) (measurement string, tags map[string]string)) *Reporter {
+	r.measurementFunc = f
+	return r
+}
+
+// CaseMode selects how letter case of measurement names and tag keys is
+// normalized.
+type CaseMode int
+
+const (
+	// KeepCase leaves names unchanged.
+	KeepCase CaseMode = iota
+	// LowerCase converts names to lower case, e.g. "HTTPRequests" to
+	// "httprequests".
+	LowerCase
+	// SnakeCase converts camel case names to snake case, e.g.
+	// "HTTPRequests" to "http_requests".
+	SnakeCase
+)
+
+// NameCase normalizes letter case of measurement names and keys of tags
+// extracted from metric names. It is applied after tag pairs are extracted,
+// measurement prefix and tags set by Tags() are not changed. Influx DB names
+// are case sensitive, so inconsistent naming otherwise splits series.
+func (r *Reporter) NameCase(mode CaseMode) *Reporter {
+	r.nameCase = mode
+	return r
+}
+
+// DisableNameTagParsing makes reporter use metric names as measurement names
+// as is, without extracting tag pairs. Commas and spaces are escaped, so a
+// metric named "p50,p99 ratio" is written to "p50,p99 ratio" measurement.
+// It is the same as MeasurementFunc() returning the name and no tags.
+func (r *Reporter) DisableNameTagParsing() *Reporter {
+	return r.MeasurementFunc(func(name string) (string, map[string]string) {
+		return name, nil
+	})
+}
+
+// PreserveMetricName adds a tag with a given key holding full metric name as it
+// is registered in the registry. It helps matching influx series back to
+// go-metrics registry keys when tags are extracted from metric names.
+func (r *Reporter) PreserveMetricName(tagKey string) *Reporter {
+	r.nameTag = tagKey
+	return r
+}
+
+// TypeTag adds a tag with a given key holding metric type to every data point.
+// Values are "counter", "gauge", "histogram", "meter", "timer", "sample" and
+// "healthcheck". It allows grouping and filtering series by metric type.
+func (r *Reporter) TypeTag(key string) *Reporter {
+	r.typeTag = key
+	return r
+}
+
+// Heartbeat makes reporter write a data point with field "up=1" to a given
+// measurement on every report, even if registry is empty. Missing heartbeat
+// points indicate that reporter is not running.
+func (r *Reporter) Heartbeat(measurement string) *Reporter {
+	r.heartbeat = measurement
+	return r
+}
+
+// SequenceField adds an integer field with a given key to heartbeat points. It
+// is incremented on every report starting from 1, so gaps and duplicates of
+// reports can be detected. Heartbeat() must be set too.
+func (r *Reporter) SequenceField(key string) *Reporter {
+	r.seqField = key
+	return r
+}
+
+// SelfMetrics makes reporter write statistics about itself to a given
+// measurement on every report. Point fields are "report_duration_ms" (duration
+// of the previous report), "point_count" and "write_errors" (number of points
+// written and failed writes since the previous statistics point).
+func (r *Reporter) SelfMetrics(measurement string) *Reporter {
+	r.selfMetrics = measurement
+	return r
+}
+
+// Include limits reported metrics to the ones with names matching at least one
+// of the patterns. Patterns are matched against full metric name, including
+// tag pairs. By default all metrics are reported.
+func (r *Reporter) Include(patterns ...*regexp.Regexp) *Reporter {
+	r.include = patterns
+	return r
+}
+
+// Exclude skips metrics with names matching any of the patterns. Patterns are
+// matched against full metric name, including tag pairs. Exclude takes
+// precedence over Include.
+func (r *Reporter) Exclude(patterns ...*regexp.Regexp) *Reporter {
+	r.exclude = patterns
+	return r
+}
+
+// MaxPointsPerReport limits number of metric data points collected by a
+// single report, protecting influx DB from a runaway registry, e.g. with
+// unbounded dynamic metric names. When the limit is reached remaining metrics
+// are skipped and a warning is logged. Metrics with names matching priority
+// patterns are collected first, the rest in name order. The limit is checked
+// before each metric, so all points of a flattened metric are kept together.
+// Heartbeat and self metrics points are not limited. Zero disables the limit.
+func (r *Reporter) MaxPointsPerReport(n uint, priority ...*regexp.Regexp) *Reporter {
+	r.maxPoints = n
+	r.priority = priority
+	return r
+}
+
+// CardinalityLimit enables warnings about series cardinality explosions. A
+// warning is logged when a report contains more than n distinct series
+// (measurement and tag set) or when the number of series grows by more than
+// n/2 since the previous report. Series count is available via
+// SeriesCount(). Zero disables both the warnings and counting of series.
+func (r *Reporter) CardinalityLimit(n uint) *Reporter {
+	r.seriesLimit = n
+	return r
+}
+
+// Context assigns a context to this reporter. Context is used to stop
+// reporter Run() method and to abort waiting between write retries. Creating
+// influx client does not perform any network I/O, so Run() does not block on
+// unreachable influx DB at startup. Each write is bounded by HTTPTimeout()
+// instead, as influx client does not support request contexts.
+func (r *Reporter) Context(ctx context.Context) *Reporter {
+	r.ctx = ctx
+	return r
+}
+
+// Logger sets optional logrus logger for error reporting.
+func (r *Reporter) Logger(log logrus.FieldLogger) *Reporter {
+	return r.CustomLogger(NewLogrusLogger(log))
+}
+
+// CustomLogger sets optional logger for error reporting. It can be used to
+// adapt reporter to any logging library. By default nothing is logged.
+func (r *Reporter) CustomLogger(log Logger) *Reporter {
+	r.log = log
+	return r
+}
+
+// OnError sets a function called with every error of writing data points to
+// influx DB, in addition to logging it. Retried writes are reported once with
+// the error of the last attempt. While Run() is active the function is called
+// from a separate goroutine, so it does not block reporting and may call other
+// reporter methods, including Close(). Errors are dropped with a warning if
+// the function falls behind. It may still be called shortly after Run()
+// returns. Otherwise, e.g. for RunOnce(), it is called synchronously before
+// the error is returned.
+func (r *Reporter) OnError(f func(err error)) *Reporter {
+	r.onError = f
+	return r
+}
+
+// Run starts exporting metrics to influx DB. This method will block until
+// context associated with this reporter is stopper (of forever if contex is
+// not set). Metrics are exported one last time before Run returns. Nil is
+// returned when reporter is stopped by the context. Non-nil error is returned
+// if influx client can not be created or a write fails with an error that will
+// not go away by retrying (e.g. authorization failure, matching ErrAuth).
+// Other write errors are logged and reporting continues on next interval.
+func (r *Reporter) Run() error {
+	done := make(chan struct{})
+	r.runMu.Lock()
+	r.done = done
+	r.runMu.Unlock()
+	defer close(done)
+
+	if err := r.Validate(); err != nil {
+		r.logError("invalid reporter configuration", "error", err)
+		return err
+	}
+	r.checkPrecision()
+	if key, ok := emptyTag(r.tags); ok {
+		r.logWarn("tag with empty key or value will be dropped by influx DB", "tag", key)
+	}
+
+	c, err := r.newClient()
+	if err != nil {
+		r.logError("creating new influx client", "url", r.url, "error", err)
+		return fmt.Errorf("creating new influx client: %w", err)
+	}
+	defer r.closeClient(c)
+
+	r.runMu.Lock()
+	r.client = c
+	if r.onError != nil {
+		r.errQueue = make(chan error, errQueueSize)
+		go r.callOnError(r.errQueue)
+	}
+	r.runMu.Unlock()
+	defer func() {
+		r.runMu.Lock()
+		r.client = nil
+		if r.errQueue != nil {
+			close(r.errQueue)
+			r.errQueue = nil
+		}
+		r.runMu.Unlock()
+	}()
+
+	if r.ping {
+		if _, _, err := c.Ping(r.timeout); err != nil {
+			if r.pingRequired {
+				r.logError("pinging influx", "url", r.url, "error", err)
+				return fmt.Errorf("pinging influx: %w", err)
+			}
+			r.logWarn("pinging influx", "url", r.url, "error", err)
+		}
+	}
+
+	if r.runtimeInterval > 0 {
+		var wg sync.WaitGroup
+		stop := make(chan struct{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.captureRuntime(stop)
+		}()
+		defer wg.Wait()
+		defer close(stop)
+	}
+
+	// Timer is used instead of a ticker to support jitter
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	next := time.Now().Add(r.nextInterval(rnd))
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			err := r.report(c, r.clock(), false)
+
+			// Skip missed reports if reporting is slower than interval
+			next = next.Add(r.nextInterval(rnd))
+			if now := time.Now(); next.Before(now) {
+				next = now.Add(r.nextInterval(rnd))
+			}
+			timer.Reset(time.Until(next))
+
+			if err == nil {
+				continue
+			}
+			r.logReportError(err)
+			if isTerminal(err) && !r.missingDynamicDatabase(err) {
+				return err
+			}
+		case <-r.ctx.Done():
+			r.finalReport(c)
+			return nil
+		case <-r.stop:
+			r.finalReport(c)
+			return nil
+		}
+	}
+}
+
+// errQueueSize is a number of errors waiting for OnError() callback while
+// Run() is active.
+const errQueueSize = 16
+
+// callOnError calls OnError() callback with errors from the queue until it is
+// closed.
+func (r *Reporter) callOnError(queue <-chan error) {
+	for err := range queue {
+		r.onError(err)
+	}
+}
+
+// notifyError passes error to OnError() callback. While Run() is active it is
+// queued, so callback can not block Run() or deadlock calling Close().
+func (r *Reporter) notifyError(err error) {
+	if r.onError == nil {
+		return
+	}
+	r.runMu.Lock()
+	queue := r.errQueue
+	if queue != nil {
+		// Sending under the lock, queue is closed under the lock too
+		select {
+		case queue <- err:
+		default:
+			r.logWarn("error callback is too slow, dropping error", "error", err)
+		}
+	}
+	r.runMu.Unlock()
+	if queue == nil {
+		r.onError(err)
+	}
+}
+
+// logReportError logs error of a report including details of the failed
+// write.
+func (r *Reporter) logReportError(err error) {
+	keyvals := []interface{}{"error", err}
+	var we *writeError
+	if errors.As(err, &we) {
+		keyvals = append(keyvals, we.logFields()...)
+	}
+	r.logError("reporting metrics to influx", keyvals...)
+}
+
+// nextInterval returns duration until the next report with jitter applied.
+func (r *Reporter) nextInterval(rnd *rand.Rand) time.Duration {
+	if r.jitter <= 0 {
+		return r.interval
+	}
+	jitter := (rnd.Float64()*2 - 1) * r.jitter * float64(r.interval)
+	return r.interval + time.Duration(jitter)
+}
+
+// captureRuntime registers Go runtime metrics in reporter registry and updates
+// them periodically until stop is closed.
+func (r *Reporter) captureRuntime(stop <-chan struct{}) {
+	metrics.RegisterRuntimeMemStats(r.registry)
+	metrics.CaptureRuntimeMemStatsOnce(r.registry)
+
+	ticker := time.NewTicker(r.runtimeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			metrics.CaptureRuntimeMemStatsOnce(r.registry)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// finalReport exports metrics changed since the last tick before reporter is
+// stopped. It gives up waiting for the write after shutdown timeout.
+func (r *Reporter) finalReport(c client.Client) {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- r.report(c, r.clock(), true)
+	}()
+
+	var timeout <-chan time.Time
+	if r.shutdownTimeout > 0 {
+		timer := time.NewTimer(r.shutdownTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case r.finalErr = <-errc:
+		if r.finalErr != nil {
+			r.logReportError(r.finalErr)
+		}
+	case <-timeout:
+		r.finalErr = fmt.Errorf("final report did not finish in %s", r.shutdownTimeout)
+		r.logWarn("final report timed out, data points may be lost", "timeout", r.shutdownTimeout)
+	}
+}
+
+// Close stops reporter Run() loop, performs one last export of metrics and
+// waits for Run() to return. It is an alternative to stopping reporter via
+// context. Error of the last export is returned, data points buffered due to
+// FlushInterval() are written by it too, so nil error means that all points
+// were accepted by influx DB. Closed reporter can not be started again.
+func (r *Reporter) Close() error {
+	r.stopOnce.Do(func() { close(r.stop) })
+
+	r.runMu.Lock()
+	done := r.done
+	r.runMu.Unlock()
+	if done == nil {
+		return nil
+	}
+	<-done
+	return r.finalErr
+}
+
+// RunOnce exports a single snapshot of metrics to influx DB and returns. It is
+// intended for batch jobs and command line tools that want to report metrics
+// once before exiting instead of running a reporter in a background goroutine.
+// Data points are written synchronously, when RunOnce returns nil all points
+// were accepted by influx DB.
+func (r *Reporter) RunOnce() error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+
+	c, err := r.newClient()
+	if err != nil {
+		return fmt.Errorf("creating new influx client: %w", err)
+	}
+	defer r.closeClient(c)
+
+	return r.report(c, r.clock(), true)
+}
+
+// Validate checks reporter configuration. It is called by Run() and
+// RunOnce(), but can be used to detect configuration errors early.
+func (r *Reporter) Validate() error {
+	if r.interval <= 0 {
+		return fmt.Errorf("invalid report interval %s: must be positive", r.interval)
+	}
+	if _, err := time.ParseDuration("1" + r.precision); r.precision != "" && err != nil {
+		return fmt.Errorf("invalid precision %q", r.precision)
+	}
+	for i, registry := range r.registries {
+		if registry == nil {
+			return fmt.Errorf("registry %d is nil", i)
+		}
+	}
+	for kind, set := range r.fieldSets {
+		known := r.knownFields(kind)
+		if known == nil {
+			return fmt.Errorf("unknown metric type %q of field set", kind)
+		}
+	fields:
+		for field := range set {
+			for _, k := range known {
+				if field == k {
+					continue fields
+				}
+			}
+			return fmt.Errorf("unknown field %q of %s field set", field, kind)
+		}
+	}
+meterFields:
+	for field := range r.meterFields {
+		for _, known := range meterFieldNames {
+			if field == known {
+				continue meterFields
+			}
+		}
+		return fmt.Errorf("unknown meter field %q", field)
+	}
+	if r.seqField != "" && r.heartbeat == "" {
+		return fmt.Errorf("sequence field requires heartbeat measurement")
+	}
+	if key, ok := emptyTag(r.tags); r.strictTags && ok {
+		return fmt.Errorf("tag %q has empty key or value", key)
+	}
+	if r.shared != nil || r.output != nil {
+		return nil
+	}
+	if r.sinkAddr != "" {
+		_, _, err := parseSocketAddr(r.sinkNetwork, r.sinkAddr)
+		return err
+	}
+	if r.udpAddr != "" {
+		if r.udpPayloadSize < 0 {
+			return fmt.Errorf("invalid UDP payload size %d: must not be negative", r.udpPayloadSize)
+		}
+		return nil
+	}
+	if r.url == "" {
+		return fmt.Errorf("influx URL is not set")
+	}
+	if r.database == "" {
+		return fmt.Errorf("influx database is not set")
+	}
+	for i, ep := range r.endpoints {
+		if ep.URL == "" {
+			return fmt.Errorf("influx URL of endpoint %d is not set", i)
+		}
+	}
+	return nil
+}
+
+// checkPrecision warns if timestamp precision is coarser than report interval.
+// In such case several reports get the same timestamp and influx DB overwrites
+// previously written points.
+func (r *Reporter) checkPrecision() {
+	if r.precision == "" {
+		return
+	}
+	precision, _ := time.ParseDuration("1" + r.precision)
+	if precision > r.interval {
+		r.logWarn("timestamp precision is coarser than report interval, points of consecutive reports may overwrite each other",
+			"precision", r.precision,
+			"interval", r.interval,
+		)
+	}
+}
+
+// isTerminal reports whether write error is caused by reporter
+// misconfiguration and further writes are pointless.
+func isTerminal(err error) bool {
+	if partialWrite(err) {
+		return false
+	}
+	// Classified the same way as errors matching ErrAuth
+	return errorCause(err) == ErrAuth || strings.Contains(err.Error(), "database not found")
+}
+
+// missingDynamicDatabase reports whether write failed because a database
+// returned by DatabaseFunc() or DefaultDatabaseFunc() does not exist. Unlike
+// a missing static database it is not a terminal error, other databases are
+// still written.
+func (r *Reporter) missingDynamicDatabase(err error) bool {
+	var we *writeError
+	if !errors.As(err, &we) || !strings.Contains(err.Error(), "database not found") {
+		return false
+	}
+	return we.dest.database != r.database
+}
+
+// Report exports current snapshot of metrics immediately. It can be used to
+// push metrics after significant events in addition to periodic exports and
+// is safe to call while Run() is active, in which case Run() client is used.
+// Otherwise it behaves the same as RunOnce().
+func (r *Reporter) Report() error {
+	r.runMu.Lock()
+	c := r.client
+	r.runMu.Unlock()
+	if c == nil {
+		return r.RunOnce()
+	}
+	return r.report(c, r.clock(), true)
+}
+
+// WriteEvent writes a single data point, e.g. a deployment annotation, to the
+// default database. Reporter tags, including HostnameTag() and VersionTag(),
+// are added to the point, given tags take precedence. Run() client is used if
+// it is active, otherwise a new client is created. Context is checked only
+// before writing, as influx client does not support request contexts.
+func (r *Reporter) WriteEvent(ctx context.Context, measurement string, tags map[string]string, fields map[string]interface{}, t time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	base := r.tags
+	if env := r.environmentTags(); len(env) > 0 {
+		base = mergeTags(env, r.tags)
+	}
+	if r.dynamicTags != nil {
+		base = mergeTags(base, r.dynamicTags())
+	}
+	point, err := newPoint(measurement, mergeTags(base, tags), fields, t)
+	if err != nil {
+		return fmt.Errorf("creating influx data point: %w", err)
+	}
+
+	r.runMu.Lock()
+	c := r.client
+	r.runMu.Unlock()
+	if c == nil {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+		if c, err = r.newClient(); err != nil {
+			return fmt.Errorf("creating new influx client: %w", err)
+		}
+		defer r.closeClient(c)
+	}
+	return r.write(c, r.defaultDestination(), []*client.Point{point})
+}
+
+// newClient creates influx DB client used to write data points.
+func (r *Reporter) newClient() (client.Client, error) {
+	if r.shared != nil {
+		return r.shared, nil
+	}
+	if r.output != nil {
+		return &lineClient{w: r.output, enc: r.encoder}, nil
+	}
+	if r.sinkAddr != "" {
+		network, addr, err := parseSocketAddr(r.sinkNetwork, r.sinkAddr)
+		if err != nil {
+			return nil, err
+		}
+		return &socketClient{network: network, address: addr, timeout: r.timeout, enc: r.encoder}, nil
+	}
+	if r.udpAddr != "" {
+		return client.NewUDPClient(client.UDPConfig{
+			Addr:        r.udpAddr,
+			PayloadSize: r.udpPayloadSize,
+		})
+	}
+	if len(r.endpoints) == 0 {
+		return r.newHTTPClient(r.url)
+	}
+
+	c := &multiClient{mode: r.endpointMode}
+	endpoints := append([]Endpoint{{URL: r.url}}, r.endpoints...)
+	for _, ep := range endpoints {
+		hc, err := r.newHTTPClient(ep.URL)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.clients = append(c.clients, endpointClient{Client: hc, database: ep.Database})
+	}
+	return c, nil
+}
+
+// newHTTPClient creates influx HTTP client of a given server.
+func (r *Reporter) newHTTPClient(addr string) (client.Client, error) {
+	conf := client.HTTPConfig{
+		Addr:        addr,
+		Timeout:     r.timeout,
+		Proxy:       r.proxy,
+		DialContext: r.dial,
+	}
+	if r.tls != nil {
+		// Influx client modifies provided TLS config and overrides
+		// InsecureSkipVerify with the one from HTTP config.
+		conf.TLSConfig = r.tls.Clone()
+		conf.InsecureSkipVerify = r.tls.InsecureSkipVerify
+	}
+	return client.NewHTTPClient(conf)
+}
+
+// closeClient closes influx client unless it is owned by the caller.
+func (r *Reporter) closeClient(c client.Client) {
+	if c != r.shared {
+		c.Close()
+	}
+}
+
+// report send current snapshot of metrics registry to influx DB. Errors
+// creating individual data points are logged, the returned error is related to
+// the whole batch. If flush interval is set, points are buffered until it
+// elapses or flush is forced.
+func (r *Reporter) report(c client.Client, now time.Time, force bool) (err error) {
+	// Callback is called after the lock is released. Errors of destinations
+	// other than the one returned are passed to it too.
+	var others []error
+	defer func() {
+		if err != nil {
+			r.notifyError(err)
+		}
+		for _, err := range others {
+			r.notifyError(err)
+		}
+	}()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	start := time.Now()
+	written := 0
+	flushed := false
+	defer func() {
+		r.stats.duration = time.Since(start)
+		r.stats.points += written
+		if err != nil {
+			r.stats.writeErrors++
+		}
+		if flushed {
+			r.setStatus(err)
+		}
+	}()
+
+	if r.pending == nil {
+		r.pending = make(map[destination][]*client.Point)
+	}
+	buffered := 0
+	for _, points := range r.pending {
+		buffered += len(points)
+	}
+	dropped := 0
+	for dest, points := range r.collect(now) {
+		if r.bufferLimit > 0 && uint(buffered+len(points)) > r.bufferLimit {
+			room := int(r.bufferLimit) - buffered
+			if room < 0 {
+				room = 0
+			}
+			dropped += len(points) - room
+			points = points[:room]
+		}
+		buffered += len(points)
+		r.pending[dest] = append(r.pending[dest], points...)
+	}
+	if dropped > 0 {
+		r.logWarn("buffer limit reached, dropping data points",
+			"dropped", dropped,
+			"limit", r.bufferLimit,
+		)
+		// Dropped gauges must not be skipped as unchanged
+		r.lastGauge = make(map[string]gaugeState)
+	}
+	// Clock only sets timestamps of points, flushes are scheduled by wall
+	// time, so a fixed clock does not stop them
+	if !force && start.Sub(r.lastFlush) < r.flush {
+		return nil
+	}
+
+	// Points are dropped if write fails to avoid unbounded buffering
+	points := r.pending
+	r.pending = nil
+	r.lastFlush = start
+	flushed = true
+
+	// A database of a single destination may not exist yet, e.g. of a new
+	// tenant, it must not block writes to the others. The first error is
+	// returned, the rest are logged and counted here.
+	var first error
+	for _, dest := range sortedDestinations(points) {
+		if err := r.write(c, dest, points[dest]); err != nil {
+			// Gauges of lost points must not be skipped as unchanged
+			r.lastGauge = make(map[string]gaugeState)
+			if !r.missingDynamicDatabase(err) {
+				return err
+			}
+			if first == nil {
+				first = err
+			} else {
+				r.logReportError(err)
+				r.stats.writeErrors++
+				others = append(others, err)
+			}
+			continue
+		}
+		written += len(points[dest])
+	}
+	return first
+}
+
+// counterState is a counter value observed by the previous report.
+type counterState struct {
+	count int64
+	time  time.Time
+}
+
+// gaugeState is a gauge value written by a previous report.
+type gaugeState struct {
+	value interface{}
+	// skipped is a number of reports skipped since the value was written
+	skipped uint
+}
+
+// unchangedGauge reports whether gauge has the same value as the last
+// written one and can be skipped. New value is recorded by collect only once
+// data point is created. It must be called with r.mu held.
+func (r *Reporter) unchangedGauge(name string, value interface{}) bool {
+	last, ok := r.lastGauge[name]
+	if ok && last.value == value && (r.gaugeRefresh == 0 || last.skipped+1 < r.gaugeRefresh) {
+		last.skipped++
+		r.lastGauge[name] = last
+		return true
+	}
+	return false
+}
+
+// reporterStats holds statistics of reporter itself written by SelfMetrics().
+// Points and write errors are counted since the last statistics point.
+type reporterStats struct {
+	duration    time.Duration
+	points      int
+	writeErrors int
+}
+
+// Reset clears state kept by reporter between reports: previous counter values
+// used to compute diffs, buffered data points, statistics and result of the
+// last write. It is safe to call while reporter is running.
+func (r *Reporter) Reset() {
+	r.mu.Lock()
+	r.lastCounter = make(map[string]counterState)
+	r.lastMeter = make(map[string]int64)
+	r.lastGauge = make(map[string]gaugeState)
+	r.emptyTags = make(map[string]bool)
+	r.nanWarned = make(map[string]bool)
+	r.pending = nil
+	r.lastFlush = time.Time{}
+	r.stats = reporterStats{}
+	r.mu.Unlock()
+
+	r.statusMu.Lock()
+	r.lastReport = time.Time{}
+	r.lastError = nil
+	r.series = 0
+	r.statusMu.Unlock()
+}
+
+// setStatus records result of writing data points to influx DB. Wall time is
+// recorded, so health checks work with a fixed or backfilling Clock().
+func (r *Reporter) setStatus(err error) {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	if err == nil {
+		r.lastReport = time.Now()
+	}
+	r.lastError = err
+}
 
-	lastCounter map[string]int64
+// LastReport returns wall time of the last report successfully written to
+// influx DB, regardless of Clock(). Zero time is returned if no report was
+// written yet. It can be used by health checks to detect a reporter that
+// stopped exporting metrics.
+func (r *Reporter) LastReport() time.Time {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	return r.lastReport
 }
 
-// NewReporter creates a new instance of influx metrcs reporter. It may be
-// further configured with helper methods. It will not start exporting metrics
-// until Run() is called.
-func NewReporter(registry metrics.Registry, interval time.Duration, url string, db string) *Reporter {
-	return &Reporter{
-		registry:  registry,
-		interval:  interval,
-		url:       url,
-		database:  db,
-		tags:      nil,
-		precision: "s",
-		ctx:       context.Background(),
-		log: &logrus.Logger{
-			Out:       ioutil.Discard,
-			Formatter: new(logrus.TextFormatter),
-			Hooks:     make(logrus.LevelHooks),
-			Level:     logrus.PanicLevel,
-		},
-		lastCounter: make(map[string]int64),
+// LastError returns error of the last attempt to write data points to influx
+// DB or nil if it succeeded. Write errors match ErrWrite.
+func (r *Reporter) LastError() error {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	return r.lastError
+}
+
+// SeriesCount returns number of distinct series (measurement and tag set) of
+// data points collected by the last report. It is always zero unless
+// CardinalityLimit() is set.
+func (r *Reporter) SeriesCount() int {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	return r.series
+}
+
+// checkCardinality records series count of collected data points and warns
+// if it exceeds cardinality limit or grows too fast. It allocates a key of
+// every point, so it runs only if the limit is set.
+func (r *Reporter) checkCardinality(points map[destination][]*client.Point) {
+	series := make(map[string]bool)
+	for _, dest := range points {
+		for _, p := range dest {
+			series[seriesKey(p)] = true
+		}
+	}
+	n := len(series)
+
+	r.statusMu.Lock()
+	prev := r.series
+	r.series = n
+	r.statusMu.Unlock()
+
+	limit := int(r.seriesLimit)
+	switch {
+	case n > limit:
+		r.logWarn("series cardinality exceeds limit", "series", n, "limit", limit)
+	case prev > 0 && n-prev > limit/2:
+		r.logWarn("series cardinality grew abnormally since previous report",
+			"series", n,
+			"previous", prev,
+			"limit", limit,
+		)
 	}
 }
 
-// Tags sets a set of tags that will be assiciated with each influx data point
-// written by this exporter.
-func (r *Reporter) Tags(tags map[string]string) *Reporter {
-	r.tags = tags
-	return r
+// seriesKey returns measurement and sorted tags of a data point.
+func seriesKey(p *client.Point) string {
+	tags := p.Tags()
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(p.Name())
+	for _, k := range keys {
+		b.WriteString("," + k + "=" + tags[k])
+	}
+	return b.String()
 }
 
-// Precision changes the timestamp precision used in reported data points. By
-// default timestamps are reported with a seconds precision. Having higher than
-// seconds precision should be useful only when export interval is less
-// than a second.
-func (r *Reporter) Precision(precision string) *Reporter {
-	r.precision = precision
-	return r
+// registryEntry is a metric copied from registry.
+type registryEntry struct {
+	name   string
+	metric interface{}
+	// priority is set if name matches priority patterns of
+	// MaxPointsPerReport()
+	priority bool
 }
 
-// Context assigns a context to this reporter. Context is only used to stop
-// reporter Run() method.
-func (r *Reporter) Context(ctx context.Context) *Reporter {
-	r.ctx = ctx
-	return r
+// LastUpdater is an optional interface of metrics which know when they were
+// last updated. Data points of such metrics are written with the last update
+// time instead of the report time, so stale values are not attributed to the
+// current instant. Zero time means that report time is used.
+type LastUpdater interface {
+	LastUpdate() time.Time
 }
 
-// Logger sets optional logrus logger for error reporting.
-func (r *Reporter) Logger(log logrus.FieldLogger) *Reporter {
-	r.log = log
-	return r
+// Points converts current snapshot of metrics registry to data points without
+// writing them, e.g. to inspect mapping of metrics in tests. Points are grouped
+// by destination database. It updates state kept between reports the same way
+// as a report does, so following report computes counter diffs relative to
+// this call.
+func (r *Reporter) Points(now time.Time) []*client.Point {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	points := r.collect(now)
+	var all []*client.Point
+	for _, dest := range sortedDestinations(points) {
+		all = append(all, points[dest]...)
+	}
+	return all
 }
 
-// Run starts exporting metrics to influx DB. This method will block until
-// context associated with this reporter is stopper (of forever if contex is
-// not set).
-func (r *Reporter) Run() {
-	c, err := client.NewHTTPClient(client.HTTPConfig{
-		Addr:    r.url,
-		Timeout: r.interval,
+// sortedDestinations returns destinations of data points in a stable order.
+func sortedDestinations(points map[destination][]*client.Point) []destination {
+	dests := make([]destination, 0, len(points))
+	for dest := range points {
+		dests = append(dests, dest)
+	}
+	sort.Slice(dests, func(i, j int) bool {
+		if dests[i].database != dests[j].database {
+			return dests[i].database < dests[j].database
+		}
+		if dests[i].rp != dests[j].rp {
+			return dests[i].rp < dests[j].rp
+		}
+		return dests[i].precision < dests[j].precision
 	})
-	if err != nil {
-		r.log.WithField("url", r.url).WithError(err).Error("creating new influx client")
-		return
+	return dests
+}
+
+// destination identifies database and retention policy data points are
+// written to and timestamp precision used to write them.
+type destination struct {
+	database  string
+	rp        string
+	precision string
+}
+
+// destination returns where data points of a given metric are written to.
+func (r *Reporter) destination(dest destination, name string) destination {
+	if r.databaseFunc != nil {
+		if db, rp := r.databaseFunc(name); db != "" {
+			dest.database = db
+			dest.rp = rp
+		}
+	}
+	if r.precisionFunc != nil {
+		if precision := r.precisionFunc(name); precision != "" {
+			dest.precision = precision
+		}
 	}
+	return dest
+}
 
-	ticker := time.NewTicker(r.interval)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ticker.C:
-			r.report(c)
-		case <-r.ctx.Done():
-			return
+// defaultDestination returns destination of data points not associated with
+// a metric.
+func (r *Reporter) defaultDestination() destination {
+	dest := destination{database: r.database, rp: r.rp, precision: r.precision}
+	if r.defaultDBFunc != nil {
+		if db, rp := r.defaultDBFunc(); db != "" {
+			dest.database = db
+			dest.rp = rp
 		}
 	}
+	return dest
 }
 
-// report send current snapshot of metrics registry to influx DB.
-func (r *Reporter) report(c client.Client) {
-	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-		Database:  r.database,
-		Precision: r.precision,
-	})
-	if err != nil {
-		r.log.WithFields(logrus.Fields{
-			"db":        r.database,
-			"precision": r.precision,
-		}).WithError(err).Error("creating influx batch points")
-		return
+// collect converts current snapshot of metrics registry to data points grouped
+// by destination. It must be called with r.mu held.
+func (r *Reporter) collect(now time.Time) map[destination][]*client.Point {
+	// Base tags are shared by all points and must not be modified
+	baseTags := r.tags
+	if env := r.environmentTags(); len(env) > 0 {
+		baseTags = mergeTags(env, r.tags)
 	}
+	if r.dynamicTags != nil {
+		baseTags = mergeTags(baseTags, r.dynamicTags())
+	}
+	baseTags = sanitizeTags(baseTags)
+	def := r.defaultDestination()
 
-	now := time.Now()
-	r.registry.Each(func(name string, i interface{}) {
-		var point *client.Point
-		var err error
+	points := make(map[destination][]*client.Point)
+	seen := make(map[string]bool)
+	collected := 0
+	each := func(name string, i interface{}) {
+		// A misbehaving metric must not stop reporting of the others
+		defer func() {
+			if v := recover(); v != nil {
+				r.logError("reporting metric panicked", "name", name, "panic", v)
+			}
+		}()
 
-		tags := make(map[string]string)
-		for key, val := range r.tags {
-			tags[key] = val
+		if !r.selected(name) {
+			return
 		}
 
-		measurement := name
-		if parts := strings.Split(name, ","); len(parts) > 1 {
-			measurement = parts[0]
-			for i := 1; i < len(parts); i++ {
-				kv := strings.Split(parts[i], "=")
-				if len(kv) == 2 {
-					tags[kv[0]] = kv[1]
-				} else {
-					measurement = fmt.Sprintf("%s,%s", measurement, parts[i])
+		measurement, nameTags := r.measurementFunc(name)
+		if r.nameCase != KeepCase {
+			measurement = convertCase(measurement, r.nameCase)
+			if len(nameTags) > 0 {
+				converted := make(map[string]string, len(nameTags))
+				for key, val := range nameTags {
+					converted[convertCase(key, r.nameCase)] = val
 				}
+				nameTags = converted
+			}
+		}
+		if key, ok := emptyTag(nameTags); ok {
+			if r.strictTags {
+				r.logError("metric has tag with empty key or value", "name", name, "tag", key)
+				return
+			}
+			// Warn only once, the metric is reported on every interval
+			if !r.emptyTags[name] {
+				r.logWarn("tag with empty key or value will be dropped by influx DB", "name", name, "tag", key)
 			}
+			r.emptyTags[name] = true
+			seen[name] = true
 		}
+		tags := baseTags
+		if len(nameTags) > 0 || r.nameTag != "" || r.typeTag != "" {
+			tags = mergeTags(baseTags, nameTags)
+			if r.nameTag != "" {
+				tags[r.nameTag] = name
+			}
+		}
+		measurement = r.prefix + measurement
 
+		var fields map[string]interface{}
+		var count int64 = -1
+		var stats bool
+		var kind string
+		// gaugeValue is recorded as the last written value of a gauge
+		var gaugeValue interface{}
 		switch metric := i.(type) {
 		case metrics.Counter:
-			count := metric.Count()
-			diff := count - r.lastCounter[name]
-			if diff < 0 {
-				diff = count
-			}
-			r.lastCounter[name] = count
-			point, err = client.NewPoint(
-				measurement,
-				tags,
-				map[string]interface{}{
-					"count": count,
-					"diff":  diff,
-				},
-				now,
-			)
+			kind = "counter"
+			count = metric.Count()
+			fields = map[string]interface{}{
+				"count": count,
+			}
+			if r.counterDiff || r.counterRate {
+				// Counters can be decremented or cleared, so diff
+				// is a signed change since the last report.
+				last, ok := r.lastCounter[name]
+				diff := count - last.count
+				if diff < 0 {
+					switch r.counterReset {
+					case DecreaseIsReset:
+						diff = count
+					case ClampToZero:
+						diff = 0
+					}
+				}
+				r.lastCounter[name] = counterState{count: count, time: now}
+				seen[name] = true
+				if r.counterDiff {
+					fields["diff"] = diff
+				}
+				if elapsed := now.Sub(last.time); r.counterRate && ok && elapsed > 0 {
+					fields["rate"] = float64(diff) / elapsed.Seconds()
+				}
+			}
 		case metrics.Gauge:
-			point, err = client.NewPoint(
-				measurement,
-				tags,
-				map[string]interface{}{
-					"value": metric.Value(),
-				},
-				now,
-			)
+			kind = "gauge"
+			value := metric.Value()
+			if r.skipGauges {
+				seen[name] = true
+				if r.unchangedGauge(name, value) {
+					return
+				}
+				gaugeValue = value
+			}
+			fields = map[string]interface{}{
+				"value": value,
+			}
 		case metrics.GaugeFloat64:
-			point, err = client.NewPoint(
-				measurement,
-				tags,
-				map[string]interface{}{
-					"value": metric.Value(),
-				},
-				now,
-			)
+			kind = "gauge"
+			value := metric.Value()
+			if r.skipGauges {
+				seen[name] = true
+				if r.unchangedGauge(name, value) {
+					return
+				}
+				gaugeValue = value
+			}
+			fields = map[string]interface{}{
+				"value": value,
+			}
 		case metrics.Histogram:
+			kind = "histogram"
+			stats = true
 			ms := metric.Snapshot()
-			ps := ms.Percentiles([]float64{0.5, 0.75, 0.95, 0.99, 0.999, 0.9999})
-			point, err = client.NewPoint(
-				measurement,
-				tags,
-				map[string]interface{}{
-					"count":    ms.Count(),
-					"max":      ms.Max(),
-					"mean":     ms.Mean(),
-					"min":      ms.Min(),
-					"stddev":   ms.StdDev(),
-					"variance": ms.Variance(),
-					"p50":      ps[0],
-					"p75":      ps[1],
-					"p95":      ps[2],
-					"p99":      ps[3],
-					"p999":     ps[4],
-					"p9999":    ps[5],
-				},
-				now,
-			)
+			count = ms.Count()
+			fields = r.distributionFields(ms, 1)
+			if r.sampleSize {
+				fields["sample_size"] = ms.Sample().Size()
+			}
 		case metrics.Meter:
+			kind = "meter"
+			stats = true
 			ms := metric.Snapshot()
-			point, err = client.NewPoint(
-				measurement,
-				tags,
-				map[string]interface{}{
-					"count": ms.Count(),
-					"m1":    ms.Rate1(),
-					"m5":    ms.Rate5(),
-					"m15":   ms.Rate15(),
-					"mean":  ms.RateMean(),
-				},
-				now,
-			)
+			count = ms.Count()
+			fields = map[string]interface{}{
+				"count": ms.Count(),
+				"m1":    ms.Rate1(),
+				"m5":    ms.Rate5(),
+				"m15":   ms.Rate15(),
+				"mean":  ms.RateMean(),
+			}
+			if r.meterDiff {
+				fields["diff"] = count - r.lastMeter[name]
+				r.lastMeter[name] = count
+				seen[name] = true
+			}
+			if r.meterFields != nil {
+				for key := range fields {
+					if !r.meterFields[key] {
+						delete(fields, key)
+					}
+				}
+			}
+			if len(fields) == 0 {
+				return
+			}
 		case metrics.Timer:
+			kind = "timer"
+			stats = true
 			ms := metric.Snapshot()
-			ps := ms.Percentiles([]float64{0.5, 0.75, 0.95, 0.99, 0.999, 0.9999})
-			point, err = client.NewPoint(
-				measurement,
-				tags,
-				map[string]interface{}{
-					"count":    ms.Count(),
-					"max":      ms.Max(),
-					"mean":     ms.Mean(),
-					"min":      ms.Min(),
-					"stddev":   ms.StdDev(),
-					"variance": ms.Variance(),
-					"p50":      ps[0],
-					"p75":      ps[1],
-					"p95":      ps[2],
-					"p99":      ps[3],
-					"p999":     ps[4],
-					"p9999":    ps[5],
-					"m1":       ms.Rate1(),
-					"m5":       ms.Rate5(),
-					"m15":      ms.Rate15(),
-					"meanrate": ms.RateMean(),
-				},
-				now,
-			)
+			count = ms.Count()
+			fields = r.distributionFields(ms, 4)
+			fields["m1"] = ms.Rate1()
+			fields["m5"] = ms.Rate5()
+			fields["m15"] = ms.Rate15()
+			fields["meanrate"] = ms.RateMean()
+		case metrics.Sample:
+			kind = "sample"
+			stats = true
+			ms := metric.Snapshot()
+			count = ms.Count()
+			fields = r.distributionFields(ms, 1)
+			if r.sampleSize {
+				fields["sample_size"] = ms.Size()
+			}
+		case metrics.Healthcheck:
+			kind = "healthcheck"
+			metric.Check()
+			fields = map[string]interface{}{
+				"healthy": 1,
+			}
+			if err := metric.Error(); err != nil {
+				fields["healthy"] = 0
+				fields["error"] = err.Error()
+			}
 		default:
 			// Unhandled metric type
 			return
 		}
+		if r.typeTag != "" {
+			tags[r.typeTag] = kind
+		}
+		ts := now
+		if lu, ok := i.(LastUpdater); ok {
+			if t := lu.LastUpdate(); !t.IsZero() {
+				ts = t
+			}
+		}
+		if r.skipEmpty && count == 0 {
+			return
+		}
+		for key := range r.dropFields {
+			delete(fields, key)
+		}
+		if set, ok := r.fieldSets[kind]; ok {
+			for key := range fields {
+				if !set[key] {
+					delete(fields, key)
+				}
+			}
+		}
+		if diff, ok := fields["diff"]; ok && kind == "counter" && r.diffField != "" {
+			delete(fields, "diff")
+			fields[r.diffField] = diff
+		}
+		r.replaceNonFinite(name, fields)
+		if r.nanWarned[name] {
+			seen[name] = true
+		}
+		if len(fields) == 0 {
+			return
+		}
+		if r.epochField != "" {
+			fields[r.epochField] = ts.UnixNano() / int64(time.Millisecond)
+		}
+		if r.forceFloat {
+			floatFields(fields)
+		}
+
+		fields = r.renameFields(fields)
+		dest := r.destination(def, name)
+		if stats && r.flattenStats {
+			// Epoch field is added to every statistic instead of being
+			// a statistic itself
+			epochKey := r.epochField
+			if name, ok := r.fieldNames[epochKey]; ok {
+				epochKey = name
+			}
+			epoch, hasEpoch := fields[epochKey]
+			keys := make([]string, 0, len(fields))
+			for key := range fields {
+				if !hasEpoch || key != epochKey {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				stat := map[string]interface{}{"value": fields[key]}
+				if hasEpoch {
+					stat[epochKey] = epoch
+				}
+				point, err := newPoint(measurement+"."+key, tags, stat, ts)
+				if err != nil {
+					r.logError("creating influx data point", "name", name, "error", err)
+					continue
+				}
+				points[dest] = append(points[dest], point)
+				collected++
+			}
+			return
+		}
+		point, err := newPoint(measurement, tags, fields, ts)
 		if err != nil {
-			r.log.WithField("name", name).WithError(err).Error("creating influx data point")
+			r.logError("creating influx data point", "name", name, "error", err)
 			return
 		}
-		bp.AddPoint(point)
+		points[dest] = append(points[dest], point)
+		collected++
+		if gaugeValue != nil {
+			r.lastGauge[name] = gaugeState{value: gaugeValue}
+		}
+	}
+	// Registries may hold a lock while calling Each callback, so metrics are
+	// copied first and converted to points without blocking their updates
+	entries := r.entries[:0]
+	add := func(name string, i interface{}) {
+		entries = append(entries, registryEntry{name: name, metric: i})
+	}
+	r.registry.Each(add)
+	for _, registry := range r.registries {
+		registry.Each(add)
+	}
+	if r.maxPoints > 0 {
+		r.sortByPriority(entries)
+	}
+	skipped := 0
+	for i := range entries {
+		if r.maxPoints > 0 && uint(collected) >= r.maxPoints {
+			// Keep state of skipped metrics, e.g. counter diff covers
+			// several reports when it is written again
+			seen[entries[i].name] = true
+			skipped++
+		} else {
+			each(entries[i].name, entries[i].metric)
+		}
+		entries[i] = registryEntry{}
+	}
+	r.entries = entries
+	if skipped > 0 {
+		r.logWarn("too many data points, skipping remaining metrics",
+			"limit", r.maxPoints,
+			"skipped", skipped,
+		)
+	}
+
+	// Forget state of metrics that were removed from the registry
+	for name := range r.lastCounter {
+		if !seen[name] {
+			delete(r.lastCounter, name)
+		}
+	}
+	for name := range r.lastMeter {
+		if !seen[name] {
+			delete(r.lastMeter, name)
+		}
+	}
+	for name := range r.emptyTags {
+		if !seen[name] {
+			delete(r.emptyTags, name)
+		}
+	}
+	for name := range r.nanWarned {
+		if !seen[name] {
+			delete(r.nanWarned, name)
+		}
+	}
+	for name := range r.lastGauge {
+		if !seen[name] {
+			delete(r.lastGauge, name)
+		}
+	}
+
+	r.seq++
+	if r.heartbeat != "" {
+		fields := map[string]interface{}{"up": 1}
+		if r.seqField != "" {
+			fields[r.seqField] = r.seq
+		}
+		point, err := newPoint(r.heartbeat, baseTags, fields, now)
+		if err != nil {
+			r.logError("creating influx data point", "name", r.heartbeat, "error", err)
+		} else {
+			points[def] = append(points[def], point)
+		}
+	}
+
+	if r.selfMetrics != "" {
+		fields := map[string]interface{}{
+			"report_duration_ms": float64(r.stats.duration) / float64(time.Millisecond),
+			"point_count":        r.stats.points,
+			"write_errors":       r.stats.writeErrors,
+		}
+		point, err := newPoint(r.selfMetrics, baseTags, fields, now)
+		if err != nil {
+			r.logError("creating influx data point", "name", r.selfMetrics, "error", err)
+		} else {
+			points[def] = append(points[def], point)
+		}
+		r.stats.points = 0
+		r.stats.writeErrors = 0
+	}
+
+	if r.seriesLimit > 0 {
+		r.checkCardinality(points)
+	}
+	return points
+}
+
+// sortByPriority sorts metrics by name, putting the ones matching priority
+// patterns first.
+func (r *Reporter) sortByPriority(entries []registryEntry) {
+	// Patterns are matched once per metric, not in every comparison
+	for i := range entries {
+		for _, re := range r.priority {
+			if re.MatchString(entries[i].name) {
+				entries[i].priority = true
+				break
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].priority != entries[j].priority {
+			return entries[i].priority
+		}
+		return entries[i].name < entries[j].name
 	})
+}
 
-	if len(bp.Points()) == 0 {
-		return
+// write sends data points to influx DB destination splitting them into batches of
+// configured size.
+func (r *Reporter) write(c client.Client, dest destination, points []*client.Point) error {
+	for len(points) > 0 {
+		n := len(points)
+		if r.batchSize > 0 && uint(n) > r.batchSize {
+			n = int(r.batchSize)
+		}
+
+		bp, err := client.NewBatchPoints(client.BatchPointsConfig{
+			Database:        dest.database,
+			RetentionPolicy: dest.rp,
+			Precision:       dest.precision,
+		})
+		if err != nil {
+			return fmt.Errorf("creating influx batch points: %w", err)
+		}
+		bp.AddPoints(points[:n])
+		if err := r.writeBatch(c, bp); err != nil {
+			return fmt.Errorf("writing data points to influx: %w", newWriteError(err, dest, n))
+		}
+		points = points[n:]
+	}
+	return nil
+}
+
+// writeBatch writes a single batch of data points retrying failed writes with
+// exponential backoff. Retries are stopped early when reporter is stopped.
+func (r *Reporter) writeBatch(c client.Client, bp client.BatchPoints) error {
+	start := time.Now()
+	delay := r.retryInterval
+	for attempt := uint(0); ; attempt++ {
+		err := c.Write(bp)
+		if err == nil || isTerminal(err) || attempt >= r.retries {
+			return err
+		}
+		if r.maxRetryTime > 0 && time.Since(start)+delay > r.maxRetryTime {
+			return err
+		}
+
+		r.logWarn("retrying influx write",
+			"attempt", attempt+1,
+			"delay", delay,
+			"error", err,
+		)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-r.ctx.Done():
+			timer.Stop()
+			return err
+		case <-r.stop:
+			timer.Stop()
+			return err
+		}
+
+		delay *= 2
+		if r.maxRetryInterval > 0 && delay > r.maxRetryInterval {
+			delay = r.maxRetryInterval
+		}
+	}
+}
+
+// distribution is a common interface of histogram, timer and sample
+// snapshots.
+type distribution interface {
+	Count() int64
+	Max() int64
+	Mean() float64
+	Min() int64
+	StdDev() float64
+	Variance() float64
+	Percentiles([]float64) []float64
+}
+
+// distributionFields returns fields describing distribution snapshot,
+// including configured percentiles. Returned map has room for extra fields.
+func (r *Reporter) distributionFields(d distribution, extra int) map[string]interface{} {
+	fields := make(map[string]interface{}, 7+len(r.percentiles)+extra)
+	fields["count"] = d.Count()
+	fields["max"] = d.Max()
+	fields["mean"] = d.Mean()
+	fields["min"] = d.Min()
+	fields["stddev"] = d.StdDev()
+	fields["variance"] = d.Variance()
+	if r.sum {
+		// Sample Sum() covers only values kept in the reservoir
+		fields["sum"] = float64(d.Count()) * d.Mean()
+	}
+	if len(r.percentiles) > 0 {
+		for i, val := range d.Percentiles(r.percentiles) {
+			fields[r.percentileNames[i]] = val
+		}
+	}
+	return fields
+}
+
+// replaceNonFinite replaces NaN and infinite float field values, which are not
+// supported by influx DB, with configured value or removes them from fields.
+// Removal is logged once per metric. It must be called with r.mu held.
+func (r *Reporter) replaceNonFinite(name string, fields map[string]interface{}) {
+	for key, val := range fields {
+		f, ok := val.(float64)
+		if !ok || !(math.IsNaN(f) || math.IsInf(f, 0)) {
+			continue
+		}
+		if r.nonFinite != nil {
+			fields[key] = *r.nonFinite
+			continue
+		}
+		// Warn only once, the metric is reported on every interval
+		if !r.nanWarned[name] {
+			r.logWarn("skipping field with non-finite value",
+				"name", name,
+				"field", key,
+				"value", f,
+			)
+			r.nanWarned[name] = true
+		}
+		delete(fields, key)
+	}
+}
+
+// floatFields converts integer field values to float64.
+func floatFields(fields map[string]interface{}) {
+	for key, val := range fields {
+		switch v := val.(type) {
+		case int:
+			fields[key] = float64(v)
+		case int64:
+			fields[key] = float64(v)
+		}
+	}
+}
+
+// renameFields replaces default field names with custom ones set by
+// FieldNames().
+func (r *Reporter) renameFields(fields map[string]interface{}) map[string]interface{} {
+	if len(r.fieldNames) == 0 {
+		return fields
+	}
+	renamed := make(map[string]interface{}, len(fields))
+	for key, val := range fields {
+		if name, ok := r.fieldNames[key]; ok {
+			key = name
+		}
+		renamed[key] = val
+	}
+	return renamed
+}
+
+// selected reports whether metric with a given name passes Include() and
+// Exclude() filters.
+func (r *Reporter) selected(name string) bool {
+	for _, re := range r.exclude {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+	if len(r.include) == 0 {
+		return true
+	}
+	for _, re := range r.include {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseName is a default measurement name function. It extracts tag pairs
+// separated by "," from metric name, elements that are not valid "key=val"
+// pairs are kept in the measurement name. Only the first "=" separates tag key
+// from value, so "a=b=c" is parsed as tag "a" with value "b=c".
+func parseName(name string) (string, map[string]string) {
+	i := strings.IndexByte(name, ',')
+	if i < 0 {
+		return name, nil
+	}
+
+	measurement := name[:i]
+	tags := make(map[string]string, strings.Count(name, ","))
+	for rest := name[i+1:]; ; {
+		part := rest
+		i = strings.IndexByte(rest, ',')
+		if i >= 0 {
+			part, rest = rest[:i], rest[i+1:]
+		}
+
+		if eq := strings.IndexByte(part, '='); eq > 0 {
+			tags[part[:eq]] = part[eq+1:]
+		} else {
+			measurement += "," + part
+		}
+
+		if i < 0 {
+			return measurement, tags
+		}
+	}
+}
+
+// convertCase converts letter case of a name according to the mode.
+func convertCase(name string, mode CaseMode) string {
+	switch mode {
+	case LowerCase:
+		return strings.ToLower(name)
+	case SnakeCase:
+		return toSnakeCase(name)
+	}
+	return name
+}
+
+// toSnakeCase converts camel case name to snake case. Word boundary is placed
+// before an upper case letter following a lower case letter or digit and
+// before the last letter of an upper case run followed by a lower case letter,
+// so "HTTPRequestsTotal" becomes "http_requests_total".
+func toSnakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	b.Grow(len(name) + 4)
+	for i, c := range runes {
+		if unicode.IsUpper(c) && i > 0 {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(c))
 	}
-	if err = c.Write(bp); err != nil {
-		r.log.WithError(err).Error("writing data points to influx")
+	return b.String()
+}
+
+// newPoint creates influx data point with sanitized measurement name, tags and
+// field keys. Spaces, commas and equal signs are escaped by the line protocol
+// encoder, but control characters and backslashes are not and could produce
+// malformed lines, so they are replaced with "_".
+func newPoint(measurement string, tags map[string]string, fields map[string]interface{}, t time.Time) (*client.Point, error) {
+	measurement = sanitize(measurement)
+	if measurement == "" {
+		return nil, fmt.Errorf("empty measurement name")
+	}
+
+	return client.NewPoint(measurement, sanitizeTags(tags), sanitizeFields(fields), t)
+}
+
+// emptyTag returns a key of some tag with empty key or value.
+func emptyTag(tags map[string]string) (string, bool) {
+	for key, val := range tags {
+		if key == "" || val == "" {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// mergeTags returns a new map with tags from both maps, tags from b take
+// precedence.
+func mergeTags(a, b map[string]string) map[string]string {
+	tags := make(map[string]string, len(a)+len(b))
+	for key, val := range a {
+		tags[key] = val
+	}
+	for key, val := range b {
+		tags[key] = val
+	}
+	return tags
+}
+
+// sanitizeTags returns tags with sanitized keys and values. Tags map is
+// returned as is if there is nothing to sanitize.
+func sanitizeTags(tags map[string]string) map[string]string {
+	clean := true
+	for key, val := range tags {
+		if !isSanitized(key) || !isSanitized(val) {
+			clean = false
+			break
+		}
+	}
+	if clean {
+		return tags
 	}
+
+	sanitized := make(map[string]string, len(tags))
+	for key, val := range tags {
+		sanitized[sanitize(key)] = sanitize(val)
+	}
+	return sanitized
+}
+
+// sanitizeFields returns fields with sanitized keys. Fields map is returned as
+// is if there is nothing to sanitize.
+func sanitizeFields(fields map[string]interface{}) map[string]interface{} {
+	clean := true
+	for key := range fields {
+		if !isSanitized(key) {
+			clean = false
+			break
+		}
+	}
+	if clean {
+		return fields
+	}
+
+	sanitized := make(map[string]interface{}, len(fields))
+	for key, val := range fields {
+		sanitized[sanitize(key)] = val
+	}
+	return sanitized
+}
+
+// sanitize replaces characters that can not be escaped in line protocol.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if isUnsafe(r) {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// isSanitized reports whether s has no characters to be replaced by sanitize.
+func isSanitized(s string) bool {
+	return strings.IndexFunc(s, isUnsafe) == -1
+}
+
+// isUnsafe reports whether character can not be escaped in line protocol.
+func isUnsafe(r rune) bool {
+	return r == '\\' || unicode.IsControl(r)
 }
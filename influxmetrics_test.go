@@ -0,0 +1,2251 @@
+package influx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	client "github.com/influxdata/influxdb/client/v2"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// fakeClient is an influx client that keeps written batches in memory.
+type fakeClient struct {
+	batches []client.BatchPoints
+	err     error
+}
+
+func (c *fakeClient) Ping(time.Duration) (time.Duration, string, error) { return 0, "", c.err }
+func (c *fakeClient) Query(client.Query) (*client.Response, error)      { return nil, nil }
+func (c *fakeClient) QueryCtx(context.Context, client.Query) (*client.Response, error) {
+	return nil, nil
+}
+func (c *fakeClient) QueryAsChunk(client.Query) (*client.ChunkedResponse, error) { return nil, nil }
+func (c *fakeClient) Close() error                                               { return nil }
+
+func (c *fakeClient) Write(bp client.BatchPoints) error {
+	c.batches = append(c.batches, bp)
+	return c.err
+}
+
+// lines returns line protocol representation of all written points.
+func (c *fakeClient) lines() []string {
+	var lines []string
+	for _, bp := range c.batches {
+		for _, p := range bp.Points() {
+			lines = append(lines, p.String())
+		}
+	}
+	return lines
+}
+
+func TestReportNames(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"hits", "hits value=1i 1000000000"},
+		{"hits,region=eu", "hits,region=eu value=1i 1000000000"},
+		{"hits,smth,a=b", "hits\\,smth,a=b value=1i 1000000000"},
+		{"hits,query=a=b", "hits,query=a\\=b value=1i 1000000000"},
+		{"cache hit rate", "cache\\ hit\\ rate value=1i 1000000000"},
+		{"cache hit,tag key=tag value", "cache\\ hit,tag\\ key=tag\\ value value=1i 1000000000"},
+		{"žvėrių skaičius,šalis=Lietuva", "žvėrių\\ skaičius,šalis=Lietuva value=1i 1000000000"},
+		{"line\nbreak,path=c:\\", "line_break,path=c:_ value=1i 1000000000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := metrics.NewRegistry()
+			g := metrics.NewGauge()
+			g.Update(1)
+			registry.Register(tt.name, g)
+
+			c := &fakeClient{}
+			r := NewReporter(registry, time.Second, "http://localhost:8086", "db")
+			if err := r.report(c, time.Unix(1, 0), true); err != nil {
+				t.Fatalf("report() error = %v", err)
+			}
+
+			lines := c.lines()
+			if len(lines) != 1 || lines[0] != tt.want {
+				t.Errorf("report() = %q, want %q", lines, tt.want)
+			}
+		})
+	}
+}
+
+// fields returns fields of the only point written in the last batch.
+func (c *fakeClient) fields(t *testing.T) map[string]interface{} {
+	t.Helper()
+	if len(c.batches) == 0 {
+		t.Fatal("no batches written")
+	}
+	points := c.batches[len(c.batches)-1].Points()
+	if len(points) != 1 {
+		t.Fatalf("got %d points, want 1", len(points))
+	}
+	fields, err := points[0].Fields()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fields
+}
+
+func TestReportDisableNameTagParsing(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("p50,p99=ratio", registry).Update(1)
+	c := &fakeClient{}
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").DisableNameTagParsing()
+	if err := r.report(c, time.Unix(1, 0), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+
+	want := []string{"p50\\,p99=ratio value=1i 1000000000"}
+	if lines := c.lines(); !reflect.DeepEqual(lines, want) {
+		t.Errorf("report() = %q, want %q", lines, want)
+	}
+}
+
+func TestReportNameCase(t *testing.T) {
+	tests := []struct {
+		mode CaseMode
+		want string
+	}{
+		{KeepCase, "app.HTTPRequestsTotal,StatusCode=OK value=1i 1000000000"},
+		{LowerCase, "app.httprequeststotal,statuscode=OK value=1i 1000000000"},
+		{SnakeCase, "app.http_requests_total,status_code=OK value=1i 1000000000"},
+	}
+	for _, tt := range tests {
+		registry := metrics.NewRegistry()
+		metrics.NewRegisteredGauge("HTTPRequestsTotal,StatusCode=OK", registry).Update(1)
+		c := &fakeClient{}
+		r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+			MeasurementPrefix("app.").
+			NameCase(tt.mode)
+		if err := r.report(c, time.Unix(1, 0), true); err != nil {
+			t.Fatalf("report() error = %v", err)
+		}
+		if lines := c.lines(); len(lines) != 1 || lines[0] != tt.want {
+			t.Errorf("mode %d: report() = %q, want %q", tt.mode, lines, tt.want)
+		}
+	}
+
+	for name, want := range map[string]string{
+		"requestDurationMs": "request_duration_ms",
+		"cpu2Usage":         "cpu2_usage",
+		"already_snake":     "already_snake",
+		"IOWait":            "io_wait",
+	} {
+		if got := toSnakeCase(name); got != want {
+			t.Errorf("toSnakeCase(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestReportCounterDiff(t *testing.T) {
+	registry := metrics.NewRegistry()
+	counter := metrics.NewRegisteredCounter("counter", registry)
+	c := &fakeClient{}
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db")
+
+	steps := []struct {
+		update func()
+		count  int64
+		diff   int64
+	}{
+		{func() { counter.Inc(10) }, 10, 10},
+		{func() {}, 10, 0},
+		{func() { counter.Clear(); counter.Inc(3) }, 3, -7},
+		{func() { counter.Inc(2) }, 5, 2},
+		{func() { counter.Dec(1) }, 4, -1},
+	}
+	for i, step := range steps {
+		step.update()
+		if err := r.report(c, time.Now(), true); err != nil {
+			t.Fatalf("step %d: report() error = %v", i, err)
+		}
+		fields := c.fields(t)
+		if fields["count"] != step.count || fields["diff"] != step.diff {
+			t.Errorf("step %d: count = %v, diff = %v, want %v, %v",
+				i, fields["count"], fields["diff"], step.count, step.diff)
+		}
+	}
+}
+
+func TestReportCounterReset(t *testing.T) {
+	tests := []struct {
+		mode CounterResetMode
+		diff int64
+	}{
+		{SignedDelta, -3},
+		{DecreaseIsReset, 7},
+		{ClampToZero, 0},
+	}
+	for _, tt := range tests {
+		registry := metrics.NewRegistry()
+		counter := metrics.NewRegisteredCounter("counter", registry)
+		c := &fakeClient{}
+		r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+			CounterReset(tt.mode).
+			CounterDiffField("delta")
+
+		counter.Inc(10)
+		if err := r.report(c, time.Now(), true); err != nil {
+			t.Fatalf("report() error = %v", err)
+		}
+		counter.Dec(3)
+		if err := r.report(c, time.Now(), true); err != nil {
+			t.Fatalf("report() error = %v", err)
+		}
+		if diff := c.fields(t)["delta"]; diff != tt.diff {
+			t.Errorf("mode %d: diff = %v, want %d", tt.mode, diff, tt.diff)
+		}
+	}
+}
+
+func TestReportCounterRate(t *testing.T) {
+	registry := metrics.NewRegistry()
+	counter := metrics.NewRegisteredCounter("counter", registry)
+	c := &fakeClient{}
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		CounterDiff(false).
+		CounterRate(true)
+
+	steps := []struct {
+		inc  int64
+		at   time.Duration
+		rate interface{}
+	}{
+		{10, 0, nil},
+		{10, time.Second, 10.0},
+		{10, 3 * time.Second, 5.0},
+	}
+	for i, step := range steps {
+		counter.Inc(step.inc)
+		if err := r.report(c, time.Unix(0, 0).Add(step.at), true); err != nil {
+			t.Fatalf("step %d: report() error = %v", i, err)
+		}
+		fields := c.fields(t)
+		if fields["rate"] != step.rate || fields["diff"] != nil {
+			t.Errorf("step %d: rate = %v, diff = %v, want %v, <nil>", i, fields["rate"], fields["diff"], step.rate)
+		}
+	}
+}
+
+func TestReportMonotonicCounters(t *testing.T) {
+	registry := metrics.NewRegistry()
+	counter := metrics.NewRegisteredCounter("counter", registry)
+	c := &fakeClient{}
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		CounterRate(true).
+		MonotonicCounters()
+
+	for i := 0; i < 2; i++ {
+		counter.Inc(10)
+		if err := r.report(c, time.Unix(int64(i), 0), true); err != nil {
+			t.Fatalf("report() error = %v", err)
+		}
+		want := map[string]interface{}{"count": int64(10 * (i + 1))}
+		if fields := c.fields(t); !reflect.DeepEqual(fields, want) {
+			t.Errorf("report %d: fields = %v, want %v", i, fields, want)
+		}
+	}
+	if len(r.lastCounter) != 0 {
+		t.Errorf("counter state = %v, want none", r.lastCounter)
+	}
+}
+
+func TestReportMeterDiff(t *testing.T) {
+	registry := metrics.NewRegistry()
+	meter := metrics.NewRegisteredMeter("meter", registry)
+	c := &fakeClient{}
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").MeterDiff(true)
+
+	for i, mark := range []int64{5, 0, 3} {
+		meter.Mark(mark)
+		if err := r.report(c, time.Now(), true); err != nil {
+			t.Fatalf("step %d: report() error = %v", i, err)
+		}
+		if diff := c.fields(t)["diff"]; diff != mark {
+			t.Errorf("step %d: diff = %v, want %v", i, diff, mark)
+		}
+	}
+}
+
+func TestReportDefaultDatabaseFunc(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("gauge", registry).Update(1)
+	c := &fakeClient{}
+	db := ""
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		DefaultDatabaseFunc(func() (string, string) { return db, "" })
+
+	for _, want := range []string{"db", "tenant1", "tenant2"} {
+		if want != "db" {
+			db = want
+		}
+		if err := r.report(c, time.Now(), true); err != nil {
+			t.Fatalf("report() error = %v", err)
+		}
+		if got := c.batches[len(c.batches)-1].Database(); got != want {
+			t.Errorf("report() wrote to database %q, want %q", got, want)
+		}
+	}
+}
+
+// missingDBClient is an influx client failing writes to missing databases.
+type missingDBClient struct {
+	fakeClient
+	missing []string
+}
+
+func (c *missingDBClient) Write(bp client.BatchPoints) error {
+	for _, db := range c.missing {
+		if bp.Database() == db {
+			return fmt.Errorf(`{"error":"database not found: \"%s\""}`, db)
+		}
+	}
+	return c.fakeClient.Write(bp)
+}
+
+func TestRunMissingDatabaseFuncDatabase(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("app.gauge", registry).Update(1)
+	metrics.NewRegisteredGauge("tenant.gauge", registry).Update(1)
+	c := &missingDBClient{missing: []string{"tenant"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	logger, _ := test.NewNullLogger()
+	r := NewReporter(registry, 10*time.Millisecond, "http://localhost:8086", "db").
+		DatabaseFunc(func(name string) (string, string) {
+			if strings.HasPrefix(name, "tenant.") {
+				return "tenant", ""
+			}
+			return "", ""
+		}).
+		Logger(logger).
+		Client(c).
+		Context(ctx)
+
+	if err := r.Run(); err != nil {
+		t.Fatalf("Run() error = %v, want nil", err)
+	}
+	if len(c.batches) < 2 {
+		t.Errorf("got %d batches of default database, want reporting to continue", len(c.batches))
+	}
+
+	// Missing static database is still terminal
+	c = &missingDBClient{missing: []string{"db"}}
+	r = NewReporter(registry, 10*time.Millisecond, "http://localhost:8086", "db").
+		Logger(logger).
+		Client(c)
+	if err := r.Run(); err == nil {
+		t.Error("Run() error = nil, want missing database error")
+	}
+}
+
+func TestReportMissingDatabasesOnError(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("app.gauge", registry).Update(1)
+	metrics.NewRegisteredGauge("tenant1.gauge", registry).Update(1)
+	metrics.NewRegisteredGauge("tenant2.gauge", registry).Update(1)
+	c := &missingDBClient{missing: []string{"tenant1", "tenant2"}}
+	var errs []error
+	logger, _ := test.NewNullLogger()
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		DatabaseFunc(func(name string) (string, string) {
+			if i := strings.IndexByte(name, '.'); strings.HasPrefix(name, "tenant") {
+				return name[:i], ""
+			}
+			return "", ""
+		}).
+		OnError(func(err error) { errs = append(errs, err) }).
+		Logger(logger)
+
+	if err := r.report(c, time.Now(), true); err == nil {
+		t.Fatal("report() error = nil, want missing database error")
+	}
+	if len(errs) != 2 {
+		t.Errorf("OnError() called with %v, want errors of both databases", errs)
+	}
+	if r.stats.writeErrors != 2 {
+		t.Errorf("write errors = %d, want 2", r.stats.writeErrors)
+	}
+	if len(c.batches) != 1 {
+		t.Errorf("got %d batches of default database, want 1", len(c.batches))
+	}
+}
+
+func TestSelected(t *testing.T) {
+	tests := []struct {
+		name    string
+		include []*regexp.Regexp
+		exclude []*regexp.Regexp
+		want    bool
+	}{
+		{"http.requests", nil, nil, true},
+		{"http.requests", []*regexp.Regexp{regexp.MustCompile("^http\\.")}, nil, true},
+		{"db.queries", []*regexp.Regexp{regexp.MustCompile("^http\\.")}, nil, false},
+		{"http.requests", nil, []*regexp.Regexp{regexp.MustCompile("^http\\.")}, false},
+		{"db.queries", nil, []*regexp.Regexp{regexp.MustCompile("^http\\.")}, true},
+		{"http.debug", []*regexp.Regexp{regexp.MustCompile("^http\\.")}, []*regexp.Regexp{regexp.MustCompile("debug")}, false},
+	}
+	for _, tt := range tests {
+		r := NewReporter(metrics.NewRegistry(), time.Second, "http://localhost:8086", "db").
+			Include(tt.include...).
+			Exclude(tt.exclude...)
+		if got := r.selected(tt.name); got != tt.want {
+			t.Errorf("selected(%q) with include %v, exclude %v = %v, want %v", tt.name, tt.include, tt.exclude, got, tt.want)
+		}
+	}
+}
+
+func TestReportSkipEmpty(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredCounter("counter", registry)
+	metrics.NewRegisteredTimer("timer", registry)
+	metrics.NewRegisteredMeter("meter", registry)
+	metrics.NewRegisteredHistogram("histogram", registry, metrics.NewUniformSample(10))
+	metrics.NewRegisteredGauge("gauge", registry).Update(0)
+	c := &fakeClient{}
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").SkipEmpty()
+	if err := r.report(c, time.Unix(1, 0), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+
+	want := []string{"gauge value=0i 1000000000"}
+	if lines := c.lines(); !reflect.DeepEqual(lines, want) {
+		t.Errorf("report() = %q, want %q", lines, want)
+	}
+}
+
+func TestReportRegistries(t *testing.T) {
+	app := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("app", app).Update(1)
+	lib := metrics.NewRegistry()
+	metrics.NewRegisteredCounter("lib", lib).Inc(2)
+	c := &fakeClient{}
+	r := NewReporter(app, time.Second, "http://localhost:8086", "db").Registries(lib)
+	if err := r.report(c, time.Unix(1, 0), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+
+	if len(c.batches) != 1 {
+		t.Fatalf("got %d batches, want 1", len(c.batches))
+	}
+	lines := c.lines()
+	sort.Strings(lines)
+	want := []string{
+		"app value=1i 1000000000",
+		"lib count=2i,diff=2i 1000000000",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("report() = %q, want %q", lines, want)
+	}
+}
+
+func TestReportStatus(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("gauge", registry).Update(1)
+	c := &fakeClient{}
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		Clock(func() time.Time { return time.Unix(1, 0) })
+	if !r.LastReport().IsZero() || r.LastError() != nil {
+		t.Errorf("initial LastReport() = %v, LastError() = %v, want zero", r.LastReport(), r.LastError())
+	}
+
+	before := time.Now()
+	if err := r.report(c, r.clock(), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+	ok := r.LastReport()
+	if ok.Before(before) || r.LastError() != nil {
+		t.Errorf("LastReport() = %v, LastError() = %v, want wall time after %v and nil", ok, r.LastError(), before)
+	}
+
+	c.err = errors.New("connection refused")
+	if err := r.report(c, r.clock(), true); err == nil {
+		t.Fatal("report() error = nil, want error")
+	}
+	if !r.LastReport().Equal(ok) || !errors.Is(r.LastError(), ErrWrite) {
+		t.Errorf("LastReport() = %v, LastError() = %v, want %v and write error", r.LastReport(), r.LastError(), ok)
+	}
+
+	c.err = nil
+	if err := r.report(c, r.clock(), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+	if r.LastReport().Before(ok) || r.LastError() != nil {
+		t.Errorf("LastReport() = %v, LastError() = %v, want recovery", r.LastReport(), r.LastError())
+	}
+}
+
+func TestReportHealthcheck(t *testing.T) {
+	registry := metrics.NewRegistry()
+	healthy := true
+	registry.Register("db", metrics.NewHealthcheck(func(h metrics.Healthcheck) {
+		if healthy {
+			h.Healthy()
+		} else {
+			h.Unhealthy(errors.New("connection lost"))
+		}
+	}))
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db")
+
+	for _, want := range []string{
+		"db healthy=1i 1000000000",
+		`db error="connection lost",healthy=0i 1000000000`,
+	} {
+		c := &fakeClient{}
+		if err := r.report(c, time.Unix(1, 0), true); err != nil {
+			t.Fatalf("report() error = %v", err)
+		}
+		if lines := c.lines(); len(lines) != 1 || lines[0] != want {
+			t.Errorf("report() = %q, want %q", lines, want)
+		}
+		healthy = false
+	}
+}
+
+func TestReportDynamicTags(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("hits,region=name", registry).Update(1)
+	c := &fakeClient{}
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		Tags(map[string]string{"env": "static", "region": "static", "role": "static"}).
+		DynamicTags(func() map[string]string {
+			return map[string]string{"region": "dynamic", "role": "dynamic"}
+		})
+	if err := r.report(c, time.Unix(1, 0), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+
+	want := []string{"hits,env=static,region=name,role=dynamic value=1i 1000000000"}
+	if lines := c.lines(); !reflect.DeepEqual(lines, want) {
+		t.Errorf("report() = %q, want %q", lines, want)
+	}
+}
+
+func TestReportFieldNames(t *testing.T) {
+	registry := metrics.NewRegistry()
+	h := metrics.NewRegisteredHistogram("latency", registry, metrics.NewUniformSample(10))
+	h.Update(5)
+	c := &fakeClient{}
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		FieldNames(map[string]string{"count": "total", "p99": "p99_ms"})
+	if err := r.report(c, time.Unix(1, 0), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+
+	fields := c.fields(t)
+	for _, key := range []string{"count", "p99"} {
+		if _, ok := fields[key]; ok {
+			t.Errorf("field %q is not renamed", key)
+		}
+	}
+	if fields["total"] != int64(1) {
+		t.Errorf("total = %v, want 1", fields["total"])
+	}
+	if fields["p99_ms"] != float64(5) {
+		t.Errorf("p99_ms = %v, want 5", fields["p99_ms"])
+	}
+	if fields["max"] != int64(5) {
+		t.Errorf("max = %v, want 5", fields["max"])
+	}
+}
+
+func TestReportSelfMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("hits", registry).Update(1)
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		SelfMetrics("reporter")
+
+	selfFields := func(c *fakeClient) map[string]interface{} {
+		t.Helper()
+		for _, p := range c.batches[len(c.batches)-1].Points() {
+			if p.Name() == "reporter" {
+				fields, err := p.Fields()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return fields
+			}
+		}
+		t.Fatal("no self metrics point written")
+		return nil
+	}
+
+	// Failed write is counted by the next report
+	c := &fakeClient{err: errors.New("timeout")}
+	if err := r.report(c, time.Unix(1, 0), true); err == nil {
+		t.Fatal("report() error = nil")
+	}
+	c = &fakeClient{}
+	if err := r.report(c, time.Unix(2, 0), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+	fields := selfFields(c)
+	if fields["point_count"] != int64(0) || fields["write_errors"] != int64(1) {
+		t.Errorf("fields = %v, want point_count=0 write_errors=1", fields)
+	}
+	if d, ok := fields["report_duration_ms"].(float64); !ok || d < 0 {
+		t.Errorf("report_duration_ms = %v, want non-negative float", fields["report_duration_ms"])
+	}
+
+	// Both the gauge and the self metrics point are counted
+	c = &fakeClient{}
+	if err := r.report(c, time.Unix(3, 0), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+	fields = selfFields(c)
+	if fields["point_count"] != int64(2) || fields["write_errors"] != int64(0) {
+		t.Errorf("fields = %v, want point_count=2 write_errors=0", fields)
+	}
+}
+
+// sampleRegistry is a registry holding samples, which are silently ignored by
+// go-metrics standard registry.
+type sampleRegistry struct {
+	metrics.Registry
+	samples map[string]metrics.Sample
+}
+
+func (r *sampleRegistry) Each(f func(string, interface{})) {
+	r.Registry.Each(f)
+	for name, s := range r.samples {
+		f(name, s)
+	}
+}
+
+func TestReportSample(t *testing.T) {
+	sample := metrics.NewUniformSample(10)
+	registry := &sampleRegistry{
+		Registry: metrics.NewRegistry(),
+		samples:  map[string]metrics.Sample{"sample": sample},
+	}
+	for _, v := range []int64{1, 2, 3, 4} {
+		sample.Update(v)
+	}
+	c := &fakeClient{}
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		Percentiles([]float64{0.5}).
+		SampleSize()
+	if err := r.report(c, time.Unix(1, 0), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+
+	want := map[string]interface{}{
+		"count":       int64(4),
+		"max":         int64(4),
+		"mean":        2.5,
+		"min":         int64(1),
+		"p50":         2.5,
+		"sample_size": int64(4),
+		"stddev":      sample.StdDev(),
+		"variance":    1.25,
+	}
+	if fields := c.fields(t); !reflect.DeepEqual(fields, want) {
+		t.Errorf("report() fields = %v, want %v", fields, want)
+	}
+}
+
+func TestReportFlattenStats(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredMeter("requests,method=GET", registry).Mark(2)
+	metrics.NewRegisteredGauge("gauge", registry).Update(1)
+	c := &fakeClient{}
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		MeasurementPrefix("app.").
+		MeterFields([]string{"count", "m1"}).
+		FlattenStats()
+	if err := r.report(c, time.Unix(1, 0), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+
+	lines := c.lines()
+	sort.Strings(lines)
+	want := []string{
+		"app.gauge value=1i 1000000000",
+		"app.requests.count,method=GET value=2i 1000000000",
+		"app.requests.m1,method=GET value=0 1000000000",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("report() = %q, want %q", lines, want)
+	}
+}
+
+func TestReportFlattenStatsSample(t *testing.T) {
+	sample := metrics.NewUniformSample(10)
+	sample.Update(5)
+	registry := &sampleRegistry{
+		Registry: metrics.NewRegistry(),
+		samples:  map[string]metrics.Sample{"sample": sample},
+	}
+	c := &fakeClient{}
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		Percentiles([]float64{0.5}).
+		FlattenStats()
+	if err := r.report(c, time.Unix(1, 0), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+
+	lines := c.lines()
+	sort.Strings(lines)
+	want := []string{
+		"sample.count value=1i 1000000000",
+		"sample.max value=5i 1000000000",
+		"sample.mean value=5 1000000000",
+		"sample.min value=5i 1000000000",
+		"sample.p50 value=5 1000000000",
+		"sample.stddev value=0 1000000000",
+		"sample.variance value=0 1000000000",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("report() = %q, want %q", lines, want)
+	}
+}
+
+func TestReportFlattenStatsEpochField(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredMeter("requests", registry).Mark(2)
+	metrics.NewRegisteredGauge("gauge", registry).Update(1)
+	c := &fakeClient{}
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		MeterFields([]string{"count", "m1"}).
+		EpochField("epoch_ms").
+		FlattenStats()
+	if err := r.report(c, time.Unix(1, 0), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+
+	lines := c.lines()
+	sort.Strings(lines)
+	want := []string{
+		"gauge epoch_ms=1000i,value=1i 1000000000",
+		"requests.count epoch_ms=1000i,value=2i 1000000000",
+		"requests.m1 epoch_ms=1000i,value=0 1000000000",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("report() = %q, want %q", lines, want)
+	}
+}
+
+func TestReportEmptyTags(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("gauge,region=", registry).Update(1)
+
+	tests := []struct {
+		strict bool
+		points int
+		level  logrus.Level
+	}{
+		{false, 2, logrus.WarnLevel},
+		{true, 0, logrus.ErrorLevel},
+	}
+	for _, tt := range tests {
+		c := &fakeClient{}
+		log, hook := test.NewNullLogger()
+		r := NewReporter(registry, time.Second, "http://localhost:8086", "db").Logger(log)
+		if tt.strict {
+			r.StrictTags()
+		}
+		for i := 0; i < 2; i++ {
+			if err := r.report(c, time.Unix(1, 0), true); err != nil {
+				t.Fatalf("report() error = %v", err)
+			}
+		}
+
+		if got := len(c.lines()); got != tt.points {
+			t.Errorf("strict %v: report() wrote %d points, want %d", tt.strict, got, tt.points)
+		}
+		if e := hook.LastEntry(); e == nil || e.Level != tt.level {
+			t.Errorf("strict %v: report() did not log empty tag at %s level", tt.strict, tt.level)
+		}
+	}
+
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		Tags(map[string]string{"host": ""}).
+		StrictTags()
+	if err := r.Validate(); err == nil {
+		t.Errorf("Validate() with empty tag value error = nil, want error")
+	}
+}
+
+func TestReportSkipUnchangedGauges(t *testing.T) {
+	registry := metrics.NewRegistry()
+	gauge := metrics.NewRegisteredGauge("gauge", registry)
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").SkipUnchangedGauges(3)
+
+	values := []int64{1, 1, 2, 2, 2, 2, 2}
+	written := []bool{true, false, true, false, false, true, false}
+	for i, v := range values {
+		gauge.Update(v)
+		c := &fakeClient{}
+		if err := r.report(c, time.Now(), true); err != nil {
+			t.Fatalf("step %d: report() error = %v", i, err)
+		}
+		if got := len(c.lines()) == 1; got != written[i] {
+			t.Errorf("step %d: gauge written = %v, want %v", i, got, written[i])
+		}
+	}
+}
+
+func TestReportSkipUnchangedGaugesWriteError(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("gauge", registry).Update(1)
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").SkipUnchangedGauges(0)
+
+	failing := &fakeClient{err: errors.New("connection refused")}
+	if err := r.report(failing, time.Now(), true); err == nil {
+		t.Fatal("report() error = nil, want write error")
+	}
+	c := &fakeClient{}
+	if err := r.report(c, time.Now(), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+	if len(c.lines()) != 1 {
+		t.Error("gauge lost by failed write was not written again")
+	}
+}
+
+func TestReportSkipUnchangedGaugesDropped(t *testing.T) {
+	registry := metrics.NewRegistry()
+	gauge := metrics.NewRegisteredGauge("gauge", registry)
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		SkipUnchangedGauges(0).
+		FlushInterval(time.Hour).
+		BufferLimit(1)
+
+	// The first report is flushed, the second one is buffered and the third
+	// one is dropped as buffer is full
+	for i, force := range []bool{false, false, true} {
+		gauge.Update(int64(i))
+		if err := r.report(&fakeClient{}, time.Now(), force); err != nil {
+			t.Fatalf("report() error = %v", err)
+		}
+	}
+	c := &fakeClient{}
+	if err := r.report(c, time.Now(), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+	if fields := c.fields(t); fields["value"] != int64(2) {
+		t.Errorf("gauge value = %v, want dropped value 2 written again", fields["value"])
+	}
+}
+
+func TestReportFlushIntervalFixedClock(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("gauge", registry).Update(1)
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		Clock(func() time.Time { return time.Unix(1, 0) }).
+		FlushInterval(10 * time.Millisecond)
+
+	c := &fakeClient{}
+	for i := 0; i < 2; i++ {
+		if err := r.report(c, r.clock(), false); err != nil {
+			t.Fatalf("report() error = %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(c.batches) != 2 {
+		t.Errorf("got %d batches, want 2 flushes with fixed clock", len(c.batches))
+	}
+}
+
+func TestReportBufferLimit(t *testing.T) {
+	registry := metrics.NewRegistry()
+	for _, name := range []string{"a.1", "a.2", "a.3", "b.1", "b.2"} {
+		metrics.NewRegisteredGauge(name, registry).Update(1)
+	}
+	logger, hook := test.NewNullLogger()
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		DatabaseFunc(func(name string) (string, string) {
+			if strings.HasPrefix(name, "b.") {
+				return "b", ""
+			}
+			return "", ""
+		}).
+		FlushInterval(time.Hour).
+		BufferLimit(6).
+		Logger(logger)
+	r.lastFlush = time.Now()
+
+	c := &fakeClient{}
+	if err := r.report(c, time.Now(), false); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+	if entry := hook.LastEntry(); entry != nil {
+		t.Errorf("unexpected log entry %q", entry.Message)
+	}
+	// Only one of five points fits into the buffer
+	if err := r.report(c, time.Now(), false); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+	if entry := hook.LastEntry(); entry == nil || entry.Data["dropped"] != 4 {
+		t.Errorf("last log entry = %v, want warning about 4 dropped points", entry)
+	}
+	if len(c.batches) != 0 {
+		t.Errorf("got %d batches before flush, want 0", len(c.batches))
+	}
+
+	if err := r.report(c, time.Now(), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+	if entry := hook.LastEntry(); entry == nil || entry.Data["dropped"] != 5 {
+		t.Errorf("last log entry = %v, want warning about 5 dropped points", entry)
+	}
+	if n := len(c.lines()); n != 6 {
+		t.Errorf("flushed %d points, want buffer limit 6", n)
+	}
+}
+
+func TestReportNonFinite(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGaugeFloat64("nan", registry).Update(math.NaN())
+	metrics.NewRegisteredGaugeFloat64("inf", registry).Update(math.Inf(1))
+
+	logger, hook := test.NewNullLogger()
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").Logger(logger)
+	for i := 0; i < 2; i++ {
+		c := &fakeClient{}
+		if err := r.report(c, time.Now(), true); err != nil {
+			t.Fatalf("report() error = %v", err)
+		}
+		if lines := c.lines(); len(lines) != 0 {
+			t.Errorf("report() = %q, want non-finite gauges skipped", lines)
+		}
+	}
+	// Warned once per metric
+	if n := len(hook.AllEntries()); n != 2 {
+		t.Errorf("got %d log entries, want 2", n)
+	}
+
+	c := &fakeClient{}
+	r = NewReporter(registry, time.Second, "http://localhost:8086", "db").NonFiniteValue(-1)
+	if err := r.report(c, time.Unix(1, 0), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+	lines := c.lines()
+	sort.Strings(lines)
+	want := []string{"inf value=-1 1000000000", "nan value=-1 1000000000"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("report() = %q, want %q", lines, want)
+	}
+}
+
+func TestReportSequenceField(t *testing.T) {
+	c := &fakeClient{}
+	r := NewReporter(metrics.NewRegistry(), time.Second, "http://localhost:8086", "db").
+		Heartbeat("reporter").
+		SequenceField("seq")
+	for seq := int64(1); seq <= 3; seq++ {
+		if err := r.report(c, time.Now(), true); err != nil {
+			t.Fatalf("report() error = %v", err)
+		}
+		if got := c.fields(t)["seq"]; got != seq {
+			t.Errorf("seq = %v, want %d", got, seq)
+		}
+	}
+
+	r = NewReporter(metrics.NewRegistry(), time.Second, "http://localhost:8086", "db").SequenceField("seq")
+	if err := r.Validate(); err == nil {
+		t.Errorf("Validate() without heartbeat error = nil, want error")
+	}
+}
+
+func TestReportTypeTag(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredCounter("requests", registry).Inc(1)
+	metrics.NewRegisteredGaugeFloat64("load", registry).Update(0.5)
+	c := &fakeClient{}
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		CounterDiff(false).
+		TypeTag("type")
+	if err := r.report(c, time.Unix(1, 0), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+
+	lines := c.lines()
+	sort.Strings(lines)
+	want := []string{
+		"load,type=gauge value=0.5 1000000000",
+		"requests,type=counter count=1i 1000000000",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("report() = %q, want %q", lines, want)
+	}
+}
+
+func TestValidateMeterFields(t *testing.T) {
+	r := NewReporter(metrics.NewRegistry(), time.Second, "http://localhost:8086", "db").
+		MeterFields([]string{"count", "rate1"})
+	if err := r.Validate(); err == nil || !strings.Contains(err.Error(), "rate1") {
+		t.Errorf("Validate() error = %v, want unknown meter field rate1", err)
+	}
+}
+
+func TestReportDropFields(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredHistogram("histogram", registry, metrics.NewUniformSample(10)).Update(1)
+	c := &fakeClient{}
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		DropFields("stddev", "variance")
+	if err := r.report(c, time.Now(), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+
+	fields := c.fields(t)
+	if _, ok := fields["count"]; !ok {
+		t.Errorf("report() fields = %v, want count field", fields)
+	}
+	for _, key := range []string{"stddev", "variance"} {
+		if _, ok := fields[key]; ok {
+			t.Errorf("report() fields = %v, want no %s field", fields, key)
+		}
+	}
+}
+
+func TestReportFieldSet(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredTimer("timer", registry).Update(time.Millisecond)
+	c := &fakeClient{}
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		FieldSet("timer", "count", "mean", "p99")
+	if err := r.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	if err := r.report(c, time.Now(), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+
+	want := map[string]interface{}{"count": int64(1), "mean": 1e6, "p99": 1e6}
+	if fields := c.fields(t); !reflect.DeepEqual(fields, want) {
+		t.Errorf("report() fields = %v, want %v", fields, want)
+	}
+
+	for _, r := range []*Reporter{
+		NewReporter(registry, time.Second, "http://localhost:8086", "db").FieldSet("timers", "count"),
+		NewReporter(registry, time.Second, "http://localhost:8086", "db").FieldSet("timer", "p42"),
+	} {
+		if err := r.Validate(); err == nil {
+			t.Errorf("Validate() with unknown field set error = nil, want error")
+		}
+	}
+}
+
+func TestReportHostnameTag(t *testing.T) {
+	host, err := os.Hostname()
+	if err != nil {
+		t.Skip(err)
+	}
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("gauge", registry).Update(1)
+
+	tests := []struct {
+		key  string
+		tags map[string]string
+		want string
+	}{
+		{"", nil, "gauge,host=" + host + " value=1i 1000000000"},
+		{"node", nil, "gauge,node=" + host + " value=1i 1000000000"},
+		{"", map[string]string{"host": "localhost"}, "gauge,host=localhost value=1i 1000000000"},
+	}
+	for _, tt := range tests {
+		c := &fakeClient{}
+		r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+			Tags(tt.tags).
+			HostnameTag(tt.key)
+		if err := r.report(c, time.Unix(1, 0), true); err != nil {
+			t.Fatalf("report() error = %v", err)
+		}
+		if lines := c.lines(); len(lines) != 1 || lines[0] != tt.want {
+			t.Errorf("report() = %q, want %q", lines, tt.want)
+		}
+	}
+}
+
+func TestReportSumField(t *testing.T) {
+	registry := metrics.NewRegistry()
+	h := metrics.NewRegisteredHistogram("histogram", registry, metrics.NewUniformSample(10))
+	for _, v := range []int64{1, 2, 3} {
+		h.Update(v)
+	}
+	c := &fakeClient{}
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").SumField()
+	if err := r.report(c, time.Now(), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+
+	if sum := c.fields(t)["sum"]; sum != 6.0 {
+		t.Errorf("sum = %v, want 6", sum)
+	}
+}
+
+func TestPoints(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredCounter("requests,method=GET", registry).Inc(3)
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db")
+
+	points := r.Points(time.Unix(1, 0))
+	want := "requests,method=GET count=3i,diff=3i 1000000000"
+	if len(points) != 1 || points[0].String() != want {
+		t.Errorf("Points() = %v, want %q", points, want)
+	}
+}
+
+func TestReportVersionTag(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("gauge", registry).Update(1)
+	c := &fakeClient{}
+	log, hook := test.NewNullLogger()
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		Logger(log).
+		VersionTag("")
+	if err := r.report(c, time.Unix(1, 0), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+
+	// Test binaries usually have no version stamped
+	want := "gauge value=1i 1000000000"
+	if version := buildVersion(); version != "" {
+		want = "gauge,version=" + version + " value=1i 1000000000"
+	} else if e := hook.LastEntry(); e == nil || e.Level != logrus.WarnLevel {
+		t.Errorf("report() did not warn about missing build version")
+	}
+	if lines := c.lines(); len(lines) != 1 || lines[0] != want {
+		t.Errorf("report() = %q, want %q", lines, want)
+	}
+}
+
+func TestPercentileName(t *testing.T) {
+	tests := []struct {
+		p    float64
+		want string
+	}{
+		{0.05, "p05"},
+		{0.5, "p50"},
+		{0.9, "p90"},
+		{0.999, "p999"},
+		{1, "p100"},
+	}
+	for _, tt := range tests {
+		if got := percentileName(tt.p); got != tt.want {
+			t.Errorf("percentileName(%v) = %q, want %q", tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestPercentiles(t *testing.T) {
+	tests := []struct {
+		percentiles []float64
+		want        []string
+	}{
+		{[]float64{0.9, 0.90, 0.5}, []string{"p90", "p50"}},
+		{[]float64{math.NaN(), -0.1, 1.1, 0.5}, []string{"p50"}},
+		{nil, nil},
+	}
+	for _, tt := range tests {
+		r := NewReporter(metrics.NewRegistry(), time.Second, "http://localhost:8086", "db").
+			Percentiles(tt.percentiles)
+		if !reflect.DeepEqual(r.percentileNames, tt.want) {
+			t.Errorf("Percentiles(%v) names = %v, want %v", tt.percentiles, r.percentileNames, tt.want)
+		}
+	}
+}
+
+func TestReportPercentilesDisabled(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredHistogram("histogram", registry, metrics.NewUniformSample(10)).Update(1)
+	c := &fakeClient{}
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").Percentiles(nil)
+	if err := r.report(c, time.Now(), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+	for field := range c.fields(t) {
+		if strings.HasPrefix(field, "p") {
+			t.Errorf("unexpected percentile field %q", field)
+		}
+	}
+}
+
+func TestOutput(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredCounter("requests,method=GET", registry).Inc(3)
+
+	var b bytes.Buffer
+	err := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		Tags(map[string]string{"host": "localhost"}).
+		Output(&b).
+		RunOnce()
+	if err != nil {
+		t.Fatalf("RunOnce() error = %v", err)
+	}
+
+	line := b.String()
+	prefix := "requests,host=localhost,method=GET count=3i,diff=3i "
+	if !strings.HasPrefix(line, prefix) || !strings.HasSuffix(line, "\n") {
+		t.Errorf("RunOnce() wrote %q, want line starting with %q", line, prefix)
+	}
+}
+
+func TestUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	defer conn.Close()
+
+	registry := metrics.NewRegistry()
+	for i := 0; i < 10; i++ {
+		metrics.NewRegisteredGauge(fmt.Sprintf("gauge%d", i), registry).Update(int64(i))
+	}
+	err = NewReporter(registry, time.Second, "", "").
+		Clock(func() time.Time { return time.Unix(1, 0) }).
+		UDP(conn.LocalAddr().String(), 64).
+		RunOnce()
+	if err != nil {
+		t.Fatalf("RunOnce() error = %v", err)
+	}
+
+	var lines []string
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for len(lines) < 10 {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom() error = %v, got %d lines", err, len(lines))
+		}
+		if n > 64 {
+			t.Errorf("packet size = %d, want at most 64", n)
+		}
+		lines = append(lines, strings.Split(strings.TrimSuffix(string(buf[:n]), "\n"), "\n")...)
+	}
+	sort.Strings(lines)
+	if want := "gauge0 value=0i 1000000000"; lines[0] != want {
+		t.Errorf("first line = %q, want %q", lines[0], want)
+	}
+}
+
+func TestUDPInvalidPayloadSize(t *testing.T) {
+	err := NewReporter(metrics.NewRegistry(), time.Second, "", "").
+		UDP("127.0.0.1:8089", -1).
+		Validate()
+	if err == nil {
+		t.Error("Validate() error = nil, want invalid payload size")
+	}
+}
+
+func TestLineProtocolSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "telegraf.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer l.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		received <- line
+	}()
+
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("queue_length", registry).Update(3)
+	err = NewReporter(registry, time.Second, "", "").
+		Clock(func() time.Time { return time.Unix(1, 500) }).
+		LineProtocolSink("", "unix://"+path).
+		RunOnce()
+	if err != nil {
+		t.Fatalf("RunOnce() error = %v", err)
+	}
+	if line, want := <-received, "queue_length value=3i 1000000000\n"; line != want {
+		t.Errorf("received %q, want %q", line, want)
+	}
+}
+
+func TestParseSocketAddr(t *testing.T) {
+	tests := []struct {
+		network, address string
+		wantNetwork      string
+		wantAddress      string
+		wantErr          bool
+	}{
+		{"tcp", "localhost:8094", "tcp", "localhost:8094", false},
+		{"", "tcp://localhost:8094", "tcp", "localhost:8094", false},
+		{"", "unix:///var/run/telegraf.sock", "unix", "/var/run/telegraf.sock", false},
+		{"udp", "localhost:8094", "", "", true},
+		{"", "localhost:8094", "", "", true},
+		{"tcp", "", "", "", true},
+	}
+	for _, tt := range tests {
+		network, address, err := parseSocketAddr(tt.network, tt.address)
+		if (err != nil) != tt.wantErr || network != tt.wantNetwork || address != tt.wantAddress {
+			t.Errorf("parseSocketAddr(%q, %q) = %q, %q, %v, want %q, %q, error %v",
+				tt.network, tt.address, network, address, err, tt.wantNetwork, tt.wantAddress, tt.wantErr)
+		}
+	}
+}
+
+func TestGraphiteEncoder(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredCounter("requests,method=GET,path=", registry).Inc(3)
+
+	var b bytes.Buffer
+	err := NewReporter(registry, time.Second, "", "").
+		Clock(func() time.Time { return time.Unix(1, 0) }).
+		Tags(map[string]string{"host": "web 1"}).
+		Output(&b).
+		Encoder(GraphiteEncoder("app.")).
+		RunOnce()
+	if err != nil {
+		t.Fatalf("RunOnce() error = %v", err)
+	}
+
+	want := "app.requests.count;host=web_1;method=GET 3 1\n" +
+		"app.requests.diff;host=web_1;method=GET 3 1\n"
+	if got := b.String(); got != want {
+		t.Errorf("RunOnce() wrote %q, want %q", got, want)
+	}
+}
+
+func TestMaxPointsPerReport(t *testing.T) {
+	registry := metrics.NewRegistry()
+	for i := 0; i < 5; i++ {
+		metrics.NewRegisteredCounter(fmt.Sprintf("requests%d", i), registry).Inc(1)
+	}
+	metrics.NewRegisteredCounter("z_important", registry).Inc(1)
+
+	logger, hook := test.NewNullLogger()
+	c := &fakeClient{}
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		Logger(logger).
+		MaxPointsPerReport(3, regexp.MustCompile("^z_"))
+	if err := r.report(c, time.Now(), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+
+	var names []string
+	for _, p := range c.batches[0].Points() {
+		names = append(names, p.Name())
+	}
+	if want := []string{"z_important", "requests0", "requests1"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("written measurements = %v, want %v", names, want)
+	}
+	if entry := hook.LastEntry(); entry == nil || entry.Data["skipped"] != 3 {
+		t.Errorf("last log entry = %v, want warning about 3 skipped metrics", entry)
+	}
+
+	// Skipped metrics are written once there is room for them
+	registry.Unregister("z_important")
+	registry.Unregister("requests0")
+	registry.Unregister("requests1")
+	c.batches = nil
+	if err := r.report(c, time.Now(), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+	for _, p := range c.batches[0].Points() {
+		if fields, _ := p.Fields(); fields["diff"] != int64(1) {
+			t.Errorf("point %s fields = %v, want diff 1", p.Name(), fields)
+		}
+	}
+}
+
+func TestCardinalityLimit(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("requests,path=/a", registry).Update(1)
+	metrics.NewRegisteredGauge("requests,path=/b", registry).Update(1)
+
+	logger, hook := test.NewNullLogger()
+	c := &fakeClient{}
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		Logger(logger).
+		CardinalityLimit(10)
+	report := func() {
+		t.Helper()
+		hook.Reset()
+		if err := r.report(c, time.Now(), true); err != nil {
+			t.Fatalf("report() error = %v", err)
+		}
+	}
+
+	unlimited := NewReporter(registry, time.Second, "http://localhost:8086", "db")
+	if err := unlimited.report(c, time.Now(), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+	if n := unlimited.SeriesCount(); n != 0 {
+		t.Errorf("SeriesCount() without limit = %d, want 0", n)
+	}
+
+	report()
+	if n := r.SeriesCount(); n != 2 {
+		t.Errorf("SeriesCount() = %d, want 2", n)
+	}
+	if entry := hook.LastEntry(); entry != nil {
+		t.Errorf("unexpected log entry %q", entry.Message)
+	}
+
+	// Growth by more than half of the limit
+	for i := 0; i < 6; i++ {
+		metrics.NewRegisteredGauge(fmt.Sprintf("requests,path=/c%d", i), registry).Update(1)
+	}
+	report()
+	if entry := hook.LastEntry(); entry == nil || entry.Data["previous"] != 2 {
+		t.Errorf("last log entry = %v, want warning about series growth", entry)
+	}
+
+	for i := 0; i < 4; i++ {
+		metrics.NewRegisteredGauge(fmt.Sprintf("requests,path=/d%d", i), registry).Update(1)
+	}
+	report()
+	if entry := hook.LastEntry(); entry == nil || entry.Data["series"] != 12 || entry.Data["limit"] != 10 {
+		t.Errorf("last log entry = %v, want warning about exceeded limit", entry)
+	}
+}
+
+func TestWriteEvent(t *testing.T) {
+	var b bytes.Buffer
+	err := NewReporter(metrics.NewRegistry(), time.Second, "http://localhost:8086", "db").
+		Tags(map[string]string{"host": "localhost", "env": "test"}).
+		Output(&b).
+		WriteEvent(context.Background(), "deployment", map[string]string{"env": "prod"},
+			map[string]interface{}{"version": "1.2.3"}, time.Unix(1, 0))
+	if err != nil {
+		t.Fatalf("WriteEvent() error = %v", err)
+	}
+
+	want := "deployment,env=prod,host=localhost version=\"1.2.3\" 1\n"
+	if got := b.String(); got != want {
+		t.Errorf("WriteEvent() wrote %q, want %q", got, want)
+	}
+}
+
+func TestWriteEventHostnameTag(t *testing.T) {
+	host, err := os.Hostname()
+	if err != nil {
+		t.Skip(err)
+	}
+	c := &fakeClient{}
+	err = NewReporter(metrics.NewRegistry(), time.Second, "http://localhost:8086", "db").
+		HostnameTag("hostname").
+		Client(c).
+		WriteEvent(context.Background(), "deployment", nil, map[string]interface{}{"version": "1.2.3"}, time.Unix(1, 0))
+	if err != nil {
+		t.Fatalf("WriteEvent() error = %v", err)
+	}
+	if tags := c.batches[0].Points()[0].Tags(); tags["hostname"] != host {
+		t.Errorf("WriteEvent() tags = %v, want hostname %q", tags, host)
+	}
+}
+
+func TestWriteEventConcurrentOutput(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("gauge", registry).Update(1)
+	var b bytes.Buffer
+	r := NewReporter(registry, time.Millisecond, "http://localhost:8086", "db").Output(&b)
+
+	errc := make(chan error, 1)
+	go func() { errc <- r.Run() }()
+	for running := false; !running; time.Sleep(time.Millisecond) {
+		r.runMu.Lock()
+		running = r.client != nil
+		r.runMu.Unlock()
+	}
+	for i := 0; i < 20; i++ {
+		err := r.WriteEvent(context.Background(), "deployment", nil, map[string]interface{}{"n": i}, time.Now())
+		if err != nil {
+			t.Fatalf("WriteEvent() error = %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if n := strings.Count(b.String(), "deployment "); n != 20 {
+		t.Errorf("output has %d events, want 20", n)
+	}
+}
+
+func TestOutputDeterministic(t *testing.T) {
+	registry := metrics.NewRegistry()
+	for i := 0; i < 20; i++ {
+		metrics.NewRegisteredHistogram(fmt.Sprintf("histogram%d", i), registry, metrics.NewUniformSample(10)).Update(int64(i))
+	}
+
+	var outputs []string
+	for i := 0; i < 2; i++ {
+		var b bytes.Buffer
+		err := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+			Clock(func() time.Time { return time.Unix(1, 0) }).
+			Output(&b).
+			RunOnce()
+		if err != nil {
+			t.Fatalf("RunOnce() error = %v", err)
+		}
+		outputs = append(outputs, b.String())
+	}
+	if outputs[0] != outputs[1] {
+		t.Errorf("RunOnce() outputs differ:\n%s\n%s", outputs[0], outputs[1])
+	}
+}
+
+func BenchmarkReportTags(b *testing.B) {
+	registry := metrics.NewRegistry()
+	for i := 0; i < 10000; i++ {
+		metrics.NewRegisteredGauge(fmt.Sprintf("gauge%d", i), registry).Update(int64(i))
+	}
+	tags := make(map[string]string)
+	for i := 0; i < 16; i++ {
+		tags[fmt.Sprintf("tag%d", i)] = fmt.Sprintf("value%d", i)
+	}
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").Tags(tags)
+	c := &lineClient{w: ioutil.Discard}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := r.report(c, time.Now(), true); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// nopClient is an influx client that discards written batches.
+type nopClient struct {
+	fakeClient
+}
+
+func (c *nopClient) Write(client.BatchPoints) error { return nil }
+
+func BenchmarkReport(b *testing.B) {
+	registry := metrics.NewRegistry()
+	for i := 0; i < 1000; i++ {
+		metrics.NewRegisteredCounter(fmt.Sprintf("counter%d,idx=%d", i, i), registry).Inc(int64(i))
+		metrics.NewRegisteredGauge(fmt.Sprintf("gauge%d", i), registry).Update(int64(i))
+		h := metrics.NewRegisteredHistogram(fmt.Sprintf("histogram%d", i), registry, metrics.NewUniformSample(100))
+		t := metrics.NewRegisteredTimer(fmt.Sprintf("timer%d,idx=%d", i, i), registry)
+		m := metrics.NewRegisteredMeter(fmt.Sprintf("meter%d", i), registry)
+		for j := 0; j < 100; j++ {
+			h.Update(int64(j))
+			t.Update(time.Duration(j) * time.Millisecond)
+			m.Mark(1)
+		}
+	}
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		Tags(map[string]string{"host": "localhost"})
+	c := &nopClient{}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := r.report(c, time.Now(), true); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// timeoutError is a network error returned by a failed connection.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestReportErrors(t *testing.T) {
+	tests := []struct {
+		err   error
+		cause error
+	}{
+		{errors.New(`{"error":"authorization failed"}`), ErrAuth},
+		{&url.Error{Op: "Post", URL: "http://localhost:8086/write", Err: timeoutError{}}, ErrConnection},
+		{errors.New(`{"error":"partial write: field type conflict"}`), nil},
+	}
+	for _, tt := range tests {
+		registry := metrics.NewRegistry()
+		metrics.NewRegisteredGauge("gauge", registry).Update(1)
+		c := &fakeClient{err: tt.err}
+		r := NewReporter(registry, time.Second, "http://localhost:8086", "db")
+
+		err := r.report(c, time.Now(), true)
+		if !errors.Is(err, ErrWrite) || !errors.Is(err, tt.err) {
+			t.Errorf("report() error = %v, want wrapped ErrWrite and %v", err, tt.err)
+		}
+		for _, cause := range []error{ErrAuth, ErrConnection} {
+			if got, want := errors.Is(err, cause), cause == tt.cause; got != want {
+				t.Errorf("errors.Is(%v, %v) = %v, want %v", err, cause, got, want)
+			}
+		}
+	}
+}
+
+func TestRunAuthError(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("gauge", registry).Update(1)
+	for _, msg := range []string{"authorization failed", "unable to parse authentication credentials"} {
+		c := &fakeClient{err: fmt.Errorf(`{"error":"%s"}`, msg)}
+		logger, _ := test.NewNullLogger()
+		r := NewReporter(registry, time.Millisecond, "http://localhost:8086", "db").
+			Retries(3).
+			Logger(logger).
+			Client(c)
+		if err := r.Run(); !errors.Is(err, ErrAuth) {
+			t.Errorf("%s: Run() error = %v, want ErrAuth", msg, err)
+		}
+		if len(c.batches) != 1 {
+			t.Errorf("%s: got %d writes, want 1 without retries", msg, len(c.batches))
+		}
+	}
+}
+
+func TestWriteErrorFields(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("cpu", registry).Update(1)
+	metrics.NewRegisteredGauge("mem", registry).Update(1)
+	body := `{"error":"partial write: field type conflict: input field \"value\" on measurement \"cpu\" is type integer, already exists as type float dropped=1"}`
+	c := &fakeClient{err: errors.New(body)}
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").RetentionPolicy("week")
+
+	var we *writeError
+	if err := r.report(c, time.Now(), true); !errors.As(err, &we) {
+		t.Fatalf("report() error = %v, want write error", err)
+	}
+	want := []interface{}{"database", "db", "rp", "week", "points", 2, "measurement", "cpu"}
+	if got := we.logFields(); !reflect.DeepEqual(got, want) {
+		t.Errorf("logFields() = %v, want %v", got, want)
+	}
+}
+
+func TestReportOnError(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("gauge", registry).Update(1)
+	c := &fakeClient{err: errors.New("connection refused")}
+
+	var errs []error
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db")
+	r.OnError(func(err error) {
+		errs = append(errs, err)
+		r.Reset()
+	})
+	for i := 0; i < 2; i++ {
+		if err := r.report(c, time.Now(), true); err == nil {
+			t.Fatal("report() error = nil, want error")
+		}
+	}
+	c.err = nil
+	if err := r.report(c, time.Now(), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+
+	if len(errs) != 2 || !errors.Is(errs[0], ErrWrite) {
+		t.Errorf("OnError() called with %v, want 2 write errors", errs)
+	}
+}
+
+func TestRunOnErrorClose(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("gauge", registry).Update(1)
+	c := &fakeClient{err: errors.New("connection refused")}
+	logger, _ := test.NewNullLogger()
+	r := NewReporter(registry, 10*time.Millisecond, "http://localhost:8086", "db").
+		Logger(logger).
+		Client(c)
+	closed := make(chan error, 1)
+	var once sync.Once
+	r.OnError(func(err error) {
+		once.Do(func() { closed <- r.Close() })
+	})
+
+	errc := make(chan error, 1)
+	go func() { errc <- r.Run() }()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after Close() from OnError callback")
+	}
+	select {
+	case err := <-closed:
+		if err == nil {
+			t.Error("Close() error = nil, want final report error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close() called from OnError callback did not return")
+	}
+}
+
+func TestStdLogger(t *testing.T) {
+	var b bytes.Buffer
+	NewStdLogger(log.New(&b, "", 0)).Log(LevelWarn, "retrying influx write", "attempt", 1, "delay", time.Second)
+
+	want := "warn retrying influx write attempt=1 delay=1s\n"
+	if got := b.String(); got != want {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+}
+
+func TestReportEndpoints(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("gauge", registry).Update(1)
+
+	tests := []struct {
+		mode    EndpointMode
+		err     bool
+		batches []int
+	}{
+		{Fanout, true, []int{1, 1, 1}},
+		{Failover, false, []int{1, 1, 0}},
+	}
+	for _, tt := range tests {
+		down := &fakeClient{err: errors.New("connection refused")}
+		backup := &fakeClient{}
+		other := &fakeClient{}
+		c := &multiClient{mode: tt.mode, clients: []endpointClient{
+			{Client: down},
+			{Client: backup, database: "backup"},
+			{Client: other},
+		}}
+		r := NewReporter(registry, time.Second, "http://localhost:8086", "db")
+
+		if err := r.report(c, time.Now(), true); (err != nil) != tt.err {
+			t.Errorf("mode %d: report() error = %v, want error %v", tt.mode, err, tt.err)
+		}
+		for i, fc := range []*fakeClient{down, backup, other} {
+			if len(fc.batches) != tt.batches[i] {
+				t.Errorf("mode %d: endpoint %d got %d batches, want %d", tt.mode, i, len(fc.batches), tt.batches[i])
+			}
+		}
+		if db := backup.batches[0].Database(); db != "backup" {
+			t.Errorf("mode %d: backup endpoint got database %q, want %q", tt.mode, db, "backup")
+		}
+	}
+}
+
+func TestReportFanoutRetry(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("gauge", registry).Update(1)
+	healthy := &fakeClient{}
+	flaky := &flakyClient{fakeClient: fakeClient{err: errors.New("timeout")}, failures: 1}
+	c := &multiClient{mode: Fanout, clients: []endpointClient{{Client: healthy}, {Client: flaky}}}
+	logger, _ := test.NewNullLogger()
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		Retries(2).
+		RetryInterval(time.Millisecond).
+		Logger(logger)
+
+	if err := r.report(c, time.Now(), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+	if len(healthy.batches) != 1 || flaky.writes != 2 {
+		t.Errorf("healthy endpoint got %d batches, flaky %d writes, want 1 and 2", len(healthy.batches), flaky.writes)
+	}
+}
+
+func TestRunFanoutAuthError(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("gauge", registry).Update(1)
+	healthy := &fakeClient{}
+	denied := &fakeClient{err: errors.New(`{"error":"authorization failed"}`)}
+	c := &multiClient{mode: Fanout, clients: []endpointClient{{Client: healthy}, {Client: denied}}}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	logger, _ := test.NewNullLogger()
+	r := NewReporter(registry, 10*time.Millisecond, "http://localhost:8086", "db").
+		Logger(logger).
+		Client(c).
+		Context(ctx)
+
+	if err := r.Run(); err != nil {
+		t.Fatalf("Run() error = %v, want reporting to continue", err)
+	}
+	if len(healthy.batches) < 2 {
+		t.Errorf("healthy endpoint got %d batches, want reporting to continue", len(healthy.batches))
+	}
+	if !errors.Is(r.LastError(), ErrAuth) {
+		t.Errorf("LastError() = %v, want ErrAuth", r.LastError())
+	}
+}
+
+func TestNilRegistry(t *testing.T) {
+	r := NewReporter(nil, time.Second, "http://localhost:8086", "db")
+	if r.registry != metrics.DefaultRegistry {
+		t.Errorf("NewReporter(nil) registry = %v, want metrics.DefaultRegistry", r.registry)
+	}
+	if err := r.Registries(metrics.NewRegistry(), nil).Validate(); err == nil {
+		t.Errorf("Validate() with nil registry error = nil, want error")
+	}
+}
+
+func TestPrefixRegistry(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("db.queries", registry).Update(1)
+	metrics.NewRegisteredGauge("http.requests", registry).Update(2)
+
+	tests := []struct {
+		strip bool
+		want  string
+	}{
+		{false, "db.queries value=1i 1000000000"},
+		{true, "queries value=1i 1000000000"},
+	}
+	for _, tt := range tests {
+		c := &fakeClient{}
+		r := NewReporter(PrefixRegistry(registry, "db.", tt.strip), time.Second, "http://localhost:8086", "db")
+		if err := r.report(c, time.Unix(1, 0), true); err != nil {
+			t.Fatalf("report() error = %v", err)
+		}
+		if lines := c.lines(); len(lines) != 1 || lines[0] != tt.want {
+			t.Errorf("strip %v: report() = %q, want %q", tt.strip, lines, tt.want)
+		}
+	}
+}
+
+func TestPerformance(t *testing.T) {
+	r := NewReporter(metrics.NewRegistry(), time.Second, "http://localhost:8086", "db").
+		Retries(5).
+		Performance(PerfConfig{BatchSize: 1000, FlushInterval: time.Minute, BufferLimit: 100000})
+
+	if r.batchSize != 1000 || r.flush != time.Minute || r.bufferLimit != 100000 {
+		t.Errorf("Performance() batch size = %d, flush = %s, buffer limit = %d", r.batchSize, r.flush, r.bufferLimit)
+	}
+	if r.retries != 5 || r.retryInterval != time.Second {
+		t.Errorf("Performance() changed retries = %d, retry interval = %s", r.retries, r.retryInterval)
+	}
+}
+
+// lockingRegistry is a registry which holds a lock while calling Each
+// callback and measures for how long the lock is held.
+type lockingRegistry struct {
+	metrics.Registry
+	held time.Duration
+}
+
+func (r *lockingRegistry) Each(f func(string, interface{})) {
+	start := time.Now()
+	r.Registry.Each(f)
+	r.held += time.Since(start)
+}
+
+func BenchmarkReportLockHold(b *testing.B) {
+	registry := &lockingRegistry{Registry: metrics.NewRegistry()}
+	for i := 0; i < 1000; i++ {
+		metrics.NewRegisteredTimer(fmt.Sprintf("timer%d", i), registry).Update(time.Millisecond)
+	}
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db")
+	c := &nopClient{}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := r.report(c, time.Now(), true); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(registry.held.Nanoseconds())/float64(b.N), "lock-ns/op")
+}
+
+// flakyClient is an influx client failing the first failures writes.
+type flakyClient struct {
+	fakeClient
+	failures int
+	writes   int
+}
+
+func (c *flakyClient) Write(bp client.BatchPoints) error {
+	c.writes++
+	if c.writes <= c.failures {
+		return c.err
+	}
+	return nil
+}
+
+func TestWriteBatchRetries(t *testing.T) {
+	bp, _ := client.NewBatchPoints(client.BatchPointsConfig{Database: "db"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name       string
+		configure  func(r *Reporter) *Reporter
+		err        error
+		failures   int
+		wantWrites int
+		wantDelays []time.Duration
+		wantErr    bool
+	}{
+		{
+			name: "backoff",
+			configure: func(r *Reporter) *Reporter {
+				return r.Retries(5).RetryInterval(time.Millisecond).MaxRetryInterval(4 * time.Millisecond)
+			},
+			err:        errors.New("timeout"),
+			failures:   4,
+			wantWrites: 5,
+			wantDelays: []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond, 4 * time.Millisecond},
+		},
+		{
+			name: "retries exhausted",
+			configure: func(r *Reporter) *Reporter {
+				return r.Retries(1).RetryInterval(time.Millisecond)
+			},
+			err:        errors.New("timeout"),
+			failures:   10,
+			wantWrites: 2,
+			wantDelays: []time.Duration{time.Millisecond},
+			wantErr:    true,
+		},
+		{
+			name: "max retry time",
+			configure: func(r *Reporter) *Reporter {
+				return r.Retries(10).RetryInterval(10 * time.Millisecond).MaxRetryTime(25 * time.Millisecond)
+			},
+			err:        errors.New("timeout"),
+			failures:   10,
+			wantWrites: 2,
+			wantDelays: []time.Duration{10 * time.Millisecond},
+			wantErr:    true,
+		},
+		{
+			name: "terminal error",
+			configure: func(r *Reporter) *Reporter {
+				return r.Retries(5).RetryInterval(time.Millisecond)
+			},
+			err:        errors.New(`{"error":"authorization failed"}`),
+			failures:   10,
+			wantWrites: 1,
+			wantErr:    true,
+		},
+		{
+			name: "context canceled",
+			configure: func(r *Reporter) *Reporter {
+				return r.Retries(5).RetryInterval(time.Hour).Context(ctx)
+			},
+			err:        errors.New("timeout"),
+			failures:   10,
+			wantWrites: 1,
+			wantDelays: []time.Duration{time.Hour},
+			wantErr:    true,
+		},
+		{
+			name: "stopped",
+			configure: func(r *Reporter) *Reporter {
+				close(r.stop)
+				return r.Retries(5).RetryInterval(time.Hour)
+			},
+			err:        errors.New("timeout"),
+			failures:   10,
+			wantWrites: 1,
+			wantDelays: []time.Duration{time.Hour},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, hook := test.NewNullLogger()
+			r := tt.configure(NewReporter(metrics.NewRegistry(), time.Second, "http://localhost:8086", "db").Logger(logger))
+			c := &flakyClient{fakeClient: fakeClient{err: tt.err}, failures: tt.failures}
+
+			err := r.writeBatch(c, bp)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("writeBatch() error = %v, want error %v", err, tt.wantErr)
+			}
+			if c.writes != tt.wantWrites {
+				t.Errorf("writeBatch() made %d writes, want %d", c.writes, tt.wantWrites)
+			}
+			var delays []time.Duration
+			for _, entry := range hook.AllEntries() {
+				delays = append(delays, entry.Data["delay"].(time.Duration))
+			}
+			if !reflect.DeepEqual(delays, tt.wantDelays) {
+				t.Errorf("retry delays = %v, want %v", delays, tt.wantDelays)
+			}
+		})
+	}
+}
+
+func TestRunInvalidInterval(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Second} {
+		r := NewReporter(metrics.NewRegistry(), interval, "http://localhost:8086", "db")
+		if err := r.Run(); err == nil {
+			t.Errorf("Run() with %s interval error = nil, want error", interval)
+		}
+	}
+}
+
+func TestRunNoGoroutineLeak(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredCounter("counter", registry).Inc(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	r := NewReporter(registry, 10*time.Millisecond, "http://localhost:8086", "db").
+		Output(ioutil.Discard).
+		RuntimeMetrics(10 * time.Millisecond).
+		Context(ctx)
+
+	errc := make(chan error, 1)
+	go func() { errc <- r.Run() }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	// go-metrics starts its own long running goroutines, so only reporter
+	// goroutines are checked.
+	deadline := time.Now().Add(time.Second)
+	for {
+		buf := make([]byte, 1<<20)
+		stacks := string(buf[:runtime.Stack(buf, true)])
+		if !strings.Contains(stacks, "go-metrics-influx.(*Reporter)") {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("reporter goroutines running after Run() returned:\n%s", stacks)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunPingOnStart(t *testing.T) {
+	c := &fakeClient{err: errors.New("connection refused")}
+	err := NewReporter(metrics.NewRegistry(), time.Second, "http://localhost:8086", "db").
+		Client(c).
+		PingOnStart(true).
+		Run()
+	if err == nil {
+		t.Errorf("Run() with failed ping error = nil, want error")
+	}
+}
+
+func TestCloseFinalReportError(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("gauge", registry).Update(1)
+	for _, fail := range []bool{false, true} {
+		c := &fakeClient{}
+		if fail {
+			c.err = errors.New("connection refused")
+		}
+		r := NewReporter(registry, time.Hour, "http://localhost:8086", "db").
+			FlushInterval(time.Hour).
+			Client(c)
+
+		errc := make(chan error, 1)
+		go func() { errc <- r.Run() }()
+		// Wait for Run() to start, otherwise Close() does not wait for it
+		for running := false; !running; time.Sleep(time.Millisecond) {
+			r.runMu.Lock()
+			running = r.client != nil
+			r.runMu.Unlock()
+		}
+
+		if err := r.Close(); (err != nil) != fail {
+			t.Errorf("Close() error = %v, want error %v", err, fail)
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+		if len(c.batches) != 1 {
+			t.Errorf("final report wrote %d batches, want 1", len(c.batches))
+		}
+	}
+}
+
+// blockingClient is an influx client whose writes block until unblock is
+// closed.
+type blockingClient struct {
+	fakeClient
+	unblock chan struct{}
+}
+
+func (c *blockingClient) Write(client.BatchPoints) error {
+	<-c.unblock
+	return nil
+}
+
+func TestCloseFinalReportTimeout(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("gauge", registry).Update(1)
+	c := &blockingClient{unblock: make(chan struct{})}
+	defer close(c.unblock)
+	logger, _ := test.NewNullLogger()
+	r := NewReporter(registry, time.Hour, "http://localhost:8086", "db").
+		ShutdownTimeout(50 * time.Millisecond).
+		Logger(logger).
+		Client(c)
+
+	errc := make(chan error, 1)
+	go func() { errc <- r.Run() }()
+	for running := false; !running; time.Sleep(time.Millisecond) {
+		r.runMu.Lock()
+		running = r.client != nil
+		r.runMu.Unlock()
+	}
+
+	start := time.Now()
+	err := r.Close()
+	if err == nil || !strings.Contains(err.Error(), "did not finish") {
+		t.Errorf("Close() error = %v, want timeout error", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Close() took %s, want about shutdown timeout", elapsed)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+}
+
+func TestRunFinalReportCounterDiff(t *testing.T) {
+	registry := metrics.NewRegistry()
+	counter := metrics.NewRegisteredCounter("counter", registry)
+	c := &fakeClient{}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := NewReporter(registry, time.Hour, "http://localhost:8086", "db").
+		Client(c).
+		Context(ctx)
+
+	errc := make(chan error, 1)
+	go func() { errc <- r.Run() }()
+	for running := false; !running; time.Sleep(time.Millisecond) {
+		r.runMu.Lock()
+		running = r.client != nil
+		r.runMu.Unlock()
+	}
+
+	counter.Inc(5)
+	if err := r.Report(); err != nil {
+		t.Fatalf("Report() error = %v", err)
+	}
+	counter.Inc(2)
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	if len(c.batches) != 2 {
+		t.Fatalf("got %d batches, want 2", len(c.batches))
+	}
+	if fields := c.fields(t); fields["count"] != int64(7) || fields["diff"] != int64(2) {
+		t.Errorf("final report count = %v, diff = %v, want 7, 2", fields["count"], fields["diff"])
+	}
+}
+
+func TestRunPrecisionWarning(t *testing.T) {
+	tests := []struct {
+		interval  time.Duration
+		precision string
+		warn      bool
+	}{
+		{100 * time.Millisecond, "s", true},
+		{100 * time.Millisecond, "ms", false},
+		{time.Second, "s", false},
+		{time.Minute, "s", false},
+	}
+	for _, tt := range tests {
+		log, hook := test.NewNullLogger()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := NewReporter(metrics.NewRegistry(), tt.interval, "http://localhost:8086", "db").
+			Precision(tt.precision).
+			Output(ioutil.Discard).
+			Logger(log).
+			Context(ctx).
+			Run()
+		if err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+
+		warned := false
+		for _, e := range hook.AllEntries() {
+			if e.Level == logrus.WarnLevel {
+				warned = true
+			}
+		}
+		if warned != tt.warn {
+			t.Errorf("interval %s, precision %q: warned = %v, want %v", tt.interval, tt.precision, warned, tt.warn)
+		}
+	}
+}
+
+// panickingGauge is a gauge which panics when its value is read.
+type panickingGauge struct {
+	metrics.NilGauge
+}
+
+func (panickingGauge) Value() int64 { panic("broken gauge") }
+
+// updatedGauge is a gauge which knows time of its last update.
+type updatedGauge struct {
+	metrics.Gauge
+	updated time.Time
+}
+
+func (g updatedGauge) LastUpdate() time.Time { return g.updated }
+
+func TestReportLastUpdate(t *testing.T) {
+	registry := metrics.NewRegistry()
+	g := updatedGauge{metrics.NewGauge(), time.Unix(1, 0)}
+	g.Update(1)
+	registry.Register("updated", g)
+	registry.Register("fresh", updatedGauge{Gauge: metrics.NewGauge()})
+
+	c := &fakeClient{}
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db")
+	if err := r.report(c, time.Unix(2, 0), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+
+	lines := c.lines()
+	sort.Strings(lines)
+	want := []string{
+		"fresh value=0i 2000000000",
+		"updated value=1i 1000000000",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("report() = %q, want %q", lines, want)
+	}
+}
+
+func TestReportRecoversPanic(t *testing.T) {
+	registry := metrics.NewRegistry()
+	registry.Register("broken", panickingGauge{})
+	metrics.NewRegisteredGauge("working", registry).Update(1)
+
+	c := &fakeClient{}
+	log, hook := test.NewNullLogger()
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").Logger(log)
+	if err := r.report(c, time.Unix(1, 0), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+
+	want := []string{"working value=1i 1000000000"}
+	if lines := c.lines(); !reflect.DeepEqual(lines, want) {
+		t.Errorf("report() = %q, want %q", lines, want)
+	}
+	if e := hook.LastEntry(); e == nil || e.Level != logrus.ErrorLevel || e.Data["name"] != "broken" {
+		t.Errorf("report() did not log panic of a broken metric")
+	}
+}
@@ -0,0 +1,29 @@
+package influxtest_test
+
+import (
+	"fmt"
+	"time"
+
+	influx "github.com/fln/go-metrics-influx"
+	"github.com/fln/go-metrics-influx/influxtest"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+func ExampleRecorder() {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredGauge("queue_length,queue=jobs", registry).Update(3)
+
+	rec := influxtest.NewRecorder()
+	err := influx.NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		Clock(func() time.Time { return time.Unix(1, 0) }).
+		Client(rec).
+		RunOnce()
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	for _, line := range rec.Lines() {
+		fmt.Println(line)
+	}
+	// Output: queue_length,queue=jobs value=3i 1000000000
+}
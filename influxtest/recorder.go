@@ -0,0 +1,106 @@
+// Package influxtest provides an in-memory influx client for testing metrics
+// reported by go-metrics-influx without running influx DB.
+package influxtest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	client "github.com/influxdata/influxdb/client/v2"
+)
+
+// errNotSupported is returned by recorder for query methods.
+var errNotSupported = errors.New("not supported by recorder")
+
+// Recorder is an influx client that keeps written batches in memory. Pass it
+// to Reporter.Client() and inspect written data points after reporting. It is
+// safe for concurrent use.
+type Recorder struct {
+	mu      sync.Mutex
+	batches []client.BatchPoints
+	err     error
+}
+
+// NewRecorder creates an empty recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Fail makes subsequent writes return a given error, batches are not
+// recorded. Nil error makes writes succeed again.
+func (r *Recorder) Fail(err error) {
+	r.mu.Lock()
+	r.err = err
+	r.mu.Unlock()
+}
+
+// Batches returns all recorded batches.
+func (r *Recorder) Batches() []client.BatchPoints {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]client.BatchPoints(nil), r.batches...)
+}
+
+// Points returns data points of all recorded batches.
+func (r *Recorder) Points() []*client.Point {
+	var points []*client.Point
+	for _, bp := range r.Batches() {
+		points = append(points, bp.Points()...)
+	}
+	return points
+}
+
+// Lines returns line protocol representation of all recorded data points
+// with nanosecond timestamps.
+func (r *Recorder) Lines() []string {
+	var lines []string
+	for _, p := range r.Points() {
+		lines = append(lines, p.String())
+	}
+	return lines
+}
+
+// Reset forgets all recorded batches.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	r.batches = nil
+	r.mu.Unlock()
+}
+
+// Write records a batch unless recorder is set to fail.
+func (r *Recorder) Write(bp client.BatchPoints) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	r.batches = append(r.batches, bp)
+	return nil
+}
+
+// Ping always succeeds.
+func (r *Recorder) Ping(time.Duration) (time.Duration, string, error) {
+	return 0, "", nil
+}
+
+// Query is not supported.
+func (r *Recorder) Query(client.Query) (*client.Response, error) {
+	return nil, errNotSupported
+}
+
+// QueryCtx is not supported.
+func (r *Recorder) QueryCtx(context.Context, client.Query) (*client.Response, error) {
+	return nil, errNotSupported
+}
+
+// QueryAsChunk is not supported.
+func (r *Recorder) QueryAsChunk(client.Query) (*client.ChunkedResponse, error) {
+	return nil, errNotSupported
+}
+
+// Close does nothing.
+func (r *Recorder) Close() error {
+	return nil
+}
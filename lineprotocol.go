@@ -0,0 +1,81 @@
+package influx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	client "github.com/influxdata/influxdb/client/v2"
+)
+
+// errNotSupported is returned by line protocol client for query methods.
+var errNotSupported = errors.New("not supported by line protocol writer")
+
+// lineClient is an influx client that writes data points encoded by encoder,
+// line protocol by default, to an io.Writer instead of sending them to influx
+// DB.
+type lineClient struct {
+	w   io.Writer
+	enc Encoder
+
+	// mu serializes writes of reports and WriteEvent()
+	mu sync.Mutex
+}
+
+// Ping always succeeds.
+func (c *lineClient) Ping(time.Duration) (time.Duration, string, error) {
+	return 0, "", nil
+}
+
+// Write writes lines of each point to the underlying writer. All
+// points of a batch are written with a single Write call. Fields of a point
+// are always sorted by key, lines are sorted too, as registry iteration order
+// is random, so the same metrics always produce byte identical output.
+func (c *lineClient) Write(bp client.BatchPoints) error {
+	enc := c.enc
+	if enc == nil {
+		enc = LineProtocolEncoder(false)
+	}
+	lines := make([]string, 0, len(bp.Points()))
+	for _, p := range bp.Points() {
+		if p == nil {
+			continue
+		}
+		lines = append(lines, enc.Encode(p, bp.Precision())...)
+	}
+	sort.Strings(lines)
+
+	var b bytes.Buffer
+	for _, line := range lines {
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.w.Write(b.Bytes())
+	return err
+}
+
+// Query is not supported.
+func (c *lineClient) Query(client.Query) (*client.Response, error) {
+	return nil, errNotSupported
+}
+
+// QueryCtx is not supported.
+func (c *lineClient) QueryCtx(context.Context, client.Query) (*client.Response, error) {
+	return nil, errNotSupported
+}
+
+// QueryAsChunk is not supported.
+func (c *lineClient) QueryAsChunk(client.Query) (*client.ChunkedResponse, error) {
+	return nil, errNotSupported
+}
+
+// Close does nothing, underlying writer is owned by the caller.
+func (c *lineClient) Close() error {
+	return nil
+}
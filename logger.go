@@ -0,0 +1,105 @@
+package influx
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Level is a severity of reporter log message.
+type Level int
+
+// Reporter logs only problems, successful reports are not logged.
+const (
+	LevelWarn Level = iota
+	LevelError
+)
+
+// String returns lower case level name.
+func (l Level) String() string {
+	switch l {
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// Logger is a minimal structured logger used by reporter. It keeps reporter
+// independent of a particular logging library. Fields are passed as
+// alternating keys and values, keys are strings. Adapters are provided for
+// logrus, log/slog and the standard log package.
+type Logger interface {
+	Log(level Level, msg string, keyvals ...interface{})
+}
+
+// nopLogger discards all messages.
+type nopLogger struct{}
+
+func (nopLogger) Log(Level, string, ...interface{}) {}
+
+// NewLogrusLogger returns Logger writing messages to logrus logger.
+func NewLogrusLogger(log logrus.FieldLogger) Logger {
+	return logrusLogger{l: log}
+}
+
+// logrusLogger writes messages to logrus logger.
+type logrusLogger struct {
+	l logrus.FieldLogger
+}
+
+func (l logrusLogger) Log(level Level, msg string, keyvals ...interface{}) {
+	fields := make(logrus.Fields, len(keyvals)/2)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if key, ok := keyvals[i].(string); ok {
+			fields[key] = keyvals[i+1]
+		}
+	}
+	entry := l.l.WithFields(fields)
+	switch level {
+	case LevelWarn:
+		entry.Warn(msg)
+	default:
+		entry.Error(msg)
+	}
+}
+
+// NewStdLogger returns Logger writing messages to the standard library logger.
+// Messages are formatted as level, message and key=value pairs separated by
+// spaces. Nil logger writes to the standard logger of log package.
+func NewStdLogger(log *log.Logger) Logger {
+	return stdLogger{l: log}
+}
+
+// stdLogger writes messages to log package logger.
+type stdLogger struct {
+	l *log.Logger
+}
+
+func (l stdLogger) Log(level Level, msg string, keyvals ...interface{}) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s", level, msg)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", keyvals[i], keyvals[i+1])
+	}
+	if l.l == nil {
+		log.Print(b.String())
+		return
+	}
+	l.l.Print(b.String())
+}
+
+// logWarn logs a warning message with fields given as alternating keys and
+// values.
+func (r *Reporter) logWarn(msg string, keyvals ...interface{}) {
+	r.log.Log(LevelWarn, msg, keyvals...)
+}
+
+// logError logs an error message with fields given as alternating keys and
+// values.
+func (r *Reporter) logError(msg string, keyvals ...interface{}) {
+	r.log.Log(LevelError, msg, keyvals...)
+}
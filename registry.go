@@ -0,0 +1,107 @@
+package influx
+
+import (
+	"strings"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// PrefixRegistry returns a view of registry containing only metrics with
+// names starting with a given prefix. If strip is true the prefix is removed
+// from names of metrics returned by the view and added to names passed to it,
+// e.g. Register("hits", c) registers "prefix.hits" in the underlying
+// registry. It allows running a separate reporter for a subset of a registry.
+func PrefixRegistry(registry metrics.Registry, prefix string, strip bool) metrics.Registry {
+	return &prefixRegistry{parent: registry, prefix: prefix, strip: strip}
+}
+
+// prefixRegistry is a registry view created by PrefixRegistry().
+type prefixRegistry struct {
+	parent metrics.Registry
+	prefix string
+	strip  bool
+}
+
+// fullName returns name of a metric in the underlying registry.
+func (r *prefixRegistry) fullName(name string) string {
+	if r.strip {
+		return r.prefix + name
+	}
+	return name
+}
+
+// Each calls f for each metric with the prefix.
+func (r *prefixRegistry) Each(f func(string, interface{})) {
+	r.parent.Each(func(name string, i interface{}) {
+		if !strings.HasPrefix(name, r.prefix) {
+			return
+		}
+		if r.strip {
+			name = name[len(r.prefix):]
+		}
+		f(name, i)
+	})
+}
+
+// Get returns metric by name or nil if it is not registered or has no
+// prefix.
+func (r *prefixRegistry) Get(name string) interface{} {
+	name = r.fullName(name)
+	if !strings.HasPrefix(name, r.prefix) {
+		return nil
+	}
+	return r.parent.Get(name)
+}
+
+// GetAll returns values of metrics with the prefix.
+func (r *prefixRegistry) GetAll() map[string]map[string]interface{} {
+	all := make(map[string]map[string]interface{})
+	for name, values := range r.parent.GetAll() {
+		if !strings.HasPrefix(name, r.prefix) {
+			continue
+		}
+		if r.strip {
+			name = name[len(r.prefix):]
+		}
+		all[name] = values
+	}
+	return all
+}
+
+// GetOrRegister gets an existing metric or registers the given one in the
+// underlying registry.
+func (r *prefixRegistry) GetOrRegister(name string, i interface{}) interface{} {
+	return r.parent.GetOrRegister(r.fullName(name), i)
+}
+
+// Register registers metric in the underlying registry.
+func (r *prefixRegistry) Register(name string, i interface{}) error {
+	return r.parent.Register(r.fullName(name), i)
+}
+
+// RunHealthchecks runs healthchecks with the prefix.
+func (r *prefixRegistry) RunHealthchecks() {
+	r.Each(func(_ string, i interface{}) {
+		if h, ok := i.(metrics.Healthcheck); ok {
+			h.Check()
+		}
+	})
+}
+
+// Unregister unregisters metric from the underlying registry.
+func (r *prefixRegistry) Unregister(name string) {
+	r.parent.Unregister(r.fullName(name))
+}
+
+// UnregisterAll unregisters all metrics with the prefix.
+func (r *prefixRegistry) UnregisterAll() {
+	var names []string
+	r.parent.Each(func(name string, _ interface{}) {
+		if strings.HasPrefix(name, r.prefix) {
+			names = append(names, name)
+		}
+	})
+	for _, name := range names {
+		r.parent.Unregister(name)
+	}
+}
@@ -0,0 +1,34 @@
+//go:build go1.21
+// +build go1.21
+
+package influx
+
+import (
+	"context"
+	"log/slog"
+)
+
+// SlogLogger sets optional log/slog logger for error reporting. It is an
+// alternative to Logger() for programs using the standard library structured
+// logging.
+func (r *Reporter) SlogLogger(log *slog.Logger) *Reporter {
+	return r.CustomLogger(NewSlogLogger(log))
+}
+
+// NewSlogLogger returns Logger writing messages to log/slog logger.
+func NewSlogLogger(log *slog.Logger) Logger {
+	return slogLogger{l: log}
+}
+
+// slogLogger writes messages to log/slog logger.
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (l slogLogger) Log(level Level, msg string, keyvals ...interface{}) {
+	lvl := slog.LevelError
+	if level == LevelWarn {
+		lvl = slog.LevelWarn
+	}
+	l.l.Log(context.Background(), lvl, msg, keyvals...)
+}
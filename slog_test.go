@@ -0,0 +1,31 @@
+//go:build go1.21
+// +build go1.21
+
+package influx
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+func TestSlogLogger(t *testing.T) {
+	registry := metrics.NewRegistry()
+	registry.Register("broken", panickingGauge{})
+
+	var b bytes.Buffer
+	r := NewReporter(registry, time.Second, "http://localhost:8086", "db").
+		SlogLogger(slog.New(slog.NewTextHandler(&b, nil)))
+	if err := r.report(&fakeClient{}, time.Unix(1, 0), true); err != nil {
+		t.Fatalf("report() error = %v", err)
+	}
+
+	want := `level=ERROR msg="reporting metric panicked" name=broken panic="broken gauge"`
+	if got := b.String(); !strings.Contains(got, want) {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,128 @@
+package influx
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	client "github.com/influxdata/influxdb/client/v2"
+)
+
+// socketClient is an influx client that writes encoded data points to a
+// stream socket, e.g. Telegraf socket listener. Connection is established on
+// the first write and re-established after a failed one.
+type socketClient struct {
+	network string
+	address string
+	timeout time.Duration
+	enc     Encoder
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// parseSocketAddr returns network and address of a socket given as URL, e.g.
+// "unix:///var/run/telegraf.sock" or "tcp://localhost:8094", when network is
+// empty.
+func parseSocketAddr(network, address string) (string, string, error) {
+	if network == "" {
+		u, err := url.Parse(address)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid socket address %q: %w", address, err)
+		}
+		network, address = u.Scheme, u.Host
+		if network == "unix" {
+			address = u.Path
+		}
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return "", "", fmt.Errorf("unsupported socket network %q", network)
+	}
+	if address == "" {
+		return "", "", fmt.Errorf("socket address is not set")
+	}
+	return network, address, nil
+}
+
+// connect returns current connection or dials a new one. Must be called with
+// the lock held.
+func (c *socketClient) connect() (net.Conn, error) {
+	if c.conn != nil {
+		return c.conn, nil
+	}
+	conn, err := net.DialTimeout(c.network, c.address, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	return conn, nil
+}
+
+// Ping connects to the socket if not connected yet.
+func (c *socketClient) Ping(time.Duration) (time.Duration, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	start := time.Now()
+	if _, err := c.connect(); err != nil {
+		return 0, "", err
+	}
+	return time.Since(start), "", nil
+}
+
+// Write writes a batch encoded by encoder, line protocol with nanosecond
+// timestamps by default, as expected by socket listeners. Connection is closed
+// if write fails.
+func (c *socketClient) Write(bp client.BatchPoints) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+	if c.timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	}
+	enc := c.enc
+	if enc == nil {
+		enc = LineProtocolEncoder(true)
+	}
+	lc := lineClient{w: conn, enc: enc}
+	if err := lc.Write(bp); err != nil {
+		conn.Close()
+		c.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Query is not supported.
+func (c *socketClient) Query(client.Query) (*client.Response, error) {
+	return nil, errNotSupported
+}
+
+// QueryCtx is not supported.
+func (c *socketClient) QueryCtx(context.Context, client.Query) (*client.Response, error) {
+	return nil, errNotSupported
+}
+
+// QueryAsChunk is not supported.
+func (c *socketClient) QueryAsChunk(client.Query) (*client.ChunkedResponse, error) {
+	return nil, errNotSupported
+}
+
+// Close closes connection to the socket.
+func (c *socketClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}